@@ -0,0 +1,307 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// AllocPolicy defines how deleted cells are selected for reuse by Put.
+type AllocPolicy uint8
+
+const (
+	// AllocBestFit reuses the smallest deleted cell that fits.
+	AllocBestFit AllocPolicy = iota
+	// AllocFirstFit reuses the first deleted cell that fits, in stream order.
+	AllocFirstFit
+	// AllocWorstFit reuses the largest deleted cell, if it fits.
+	AllocWorstFit
+	// AllocSizeClass keeps deleted cells in power of two size classes and
+	// reuses a cell from the smallest class that fits.
+	AllocSizeClass
+	// AllocPageAffinity reuses the best fitting deleted cell on the page of
+	// the last reused cell, then on the newest page, then anywhere.
+	AllocPageAffinity
+)
+
+// allocator manages deleted cells and selects them for reuse.
+type allocator interface {
+	// Trash adds a deleted cell to allocator.
+	Trash(c *cell)
+	// Recycle removes and returns a cell whose Allocated satisfies minsize
+	// or returns an empty cell if none such found.
+	Recycle(minsize int64) *cell
+	// Restore removes c from allocator and returns truth if it was found.
+	Restore(c *cell) bool
+	// Len returns number of cells in the allocator.
+	Len() int
+}
+
+// newAllocator returns an allocator for specified policy.
+func newAllocator(policy AllocPolicy) allocator {
+	switch policy {
+	case AllocFirstFit:
+		return newFirstFit()
+	case AllocWorstFit:
+		return newWorstFit()
+	case AllocSizeClass:
+		return newSizeClass()
+	case AllocPageAffinity:
+		return newPageAffinity()
+	}
+	return newBin()
+}
+
+// firstFit is an allocator that keeps cells ordered by their position in
+// the stream and reuses the first one that fits.
+type firstFit struct {
+	cells   []*cell
+	cellids map[CellID]*cell
+}
+
+// newFirstFit returns a new firstFit allocator.
+func newFirstFit() *firstFit {
+	return &firstFit{
+		cellids: make(map[CellID]*cell),
+	}
+}
+
+// search returns the index of the first cell not positioned before c.
+func (ff *firstFit) search(c *cell) int {
+	return sort.Search(len(ff.cells), func(i int) bool {
+		if ff.cells[i].PageIndex != c.PageIndex {
+			return ff.cells[i].PageIndex > c.PageIndex
+		}
+		return ff.cells[i].Offset >= c.Offset
+	})
+}
+
+// Trash implements allocator.Trash.
+func (ff *firstFit) Trash(c *cell) {
+	i := ff.search(c)
+	ff.cells = append(ff.cells, nil)
+	copy(ff.cells[i+1:], ff.cells[i:])
+	ff.cells[i] = c
+	ff.cellids[c.CellID] = c
+}
+
+// Recycle implements allocator.Recycle.
+func (ff *firstFit) Recycle(minsize int64) *cell {
+	for i, c := range ff.cells {
+		if c.Allocated >= minsize {
+			ff.remove(i)
+			return c
+		}
+	}
+	return &cell{}
+}
+
+// Restore implements allocator.Restore.
+func (ff *firstFit) Restore(c *cell) bool {
+	if _, ok := ff.cellids[c.CellID]; !ok {
+		return false
+	}
+	for i := ff.search(c); i < len(ff.cells); i++ {
+		if ff.cells[i].CellID == c.CellID {
+			ff.remove(i)
+			return true
+		}
+	}
+	return false
+}
+
+// Len implements allocator.Len.
+func (ff *firstFit) Len() int {
+	return len(ff.cells)
+}
+
+// remove removes a cell at index i.
+func (ff *firstFit) remove(i int) {
+	delete(ff.cellids, ff.cells[i].CellID)
+	copy(ff.cells[i:], ff.cells[i+1:])
+	ff.cells[len(ff.cells)-1] = nil
+	ff.cells = ff.cells[:len(ff.cells)-1]
+}
+
+// worstFit is an allocator that reuses the largest cell.
+type worstFit struct {
+	*bin
+}
+
+// newWorstFit returns a new worstFit allocator.
+func newWorstFit() *worstFit {
+	return &worstFit{newBin()}
+}
+
+// Recycle implements allocator.Recycle.
+func (wf *worstFit) Recycle(minsize int64) *cell {
+	i := len(wf.cells) - 1
+	if i < 0 || wf.cells[i].Allocated < minsize {
+		return &cell{}
+	}
+	return wf.remove(i)
+}
+
+// sizeClass is an allocator that keeps cells in power of two size classes.
+// Class n holds cells whose Allocated is in range [2^(n-1), 2^n).
+type sizeClass struct {
+	classes [65][]*cell
+	cellids map[CellID]*cell
+	count   int
+}
+
+// newSizeClass returns a new sizeClass allocator.
+func newSizeClass() *sizeClass {
+	return &sizeClass{
+		cellids: make(map[CellID]*cell),
+	}
+}
+
+// class returns size class of size.
+func (sc *sizeClass) class(size int64) int {
+	if size < 0 {
+		return 0
+	}
+	return bits.Len64(uint64(size))
+}
+
+// Trash implements allocator.Trash.
+func (sc *sizeClass) Trash(c *cell) {
+	n := sc.class(c.Allocated)
+	sc.classes[n] = append(sc.classes[n], c)
+	sc.cellids[c.CellID] = c
+	sc.count++
+}
+
+// Recycle implements allocator.Recycle.
+func (sc *sizeClass) Recycle(minsize int64) *cell {
+	n := sc.class(minsize)
+	// Class of minsize may hold cells smaller than minsize.
+	for i, c := range sc.classes[n] {
+		if c.Allocated >= minsize {
+			sc.remove(n, i)
+			return c
+		}
+	}
+	// Any cell from a higher class fits.
+	for n++; n < len(sc.classes); n++ {
+		if l := len(sc.classes[n]); l > 0 {
+			c := sc.classes[n][l-1]
+			sc.remove(n, l-1)
+			return c
+		}
+	}
+	return &cell{}
+}
+
+// Restore implements allocator.Restore.
+func (sc *sizeClass) Restore(c *cell) bool {
+	if _, ok := sc.cellids[c.CellID]; !ok {
+		return false
+	}
+	n := sc.class(c.Allocated)
+	for i, v := range sc.classes[n] {
+		if v.CellID == c.CellID {
+			sc.remove(n, i)
+			return true
+		}
+	}
+	return false
+}
+
+// Len implements allocator.Len.
+func (sc *sizeClass) Len() int {
+	return sc.count
+}
+
+// remove removes a cell at index i from class n.
+func (sc *sizeClass) remove(n, i int) {
+	cells := sc.classes[n]
+	delete(sc.cellids, cells[i].CellID)
+	last := len(cells) - 1
+	cells[i] = cells[last]
+	cells[last] = nil
+	sc.classes[n] = cells[:last]
+	sc.count--
+}
+
+// pageAffinity is an allocator that prefers cells on the page of the last
+// reused cell, then on the newest page, then best fit from any page.
+type pageAffinity struct {
+	all    *bin
+	pages  map[int64]*bin
+	last   int64
+	newest int64
+}
+
+// newPageAffinity returns a new pageAffinity allocator.
+func newPageAffinity() *pageAffinity {
+	return &pageAffinity{
+		all:   newBin(),
+		pages: make(map[int64]*bin),
+		last:  -1,
+	}
+}
+
+// Trash implements allocator.Trash.
+func (pa *pageAffinity) Trash(c *cell) {
+	pb, ok := pa.pages[c.PageIndex]
+	if !ok {
+		pb = newBin()
+		pa.pages[c.PageIndex] = pb
+	}
+	pb.Trash(c)
+	pa.all.Trash(c)
+	if c.PageIndex > pa.newest {
+		pa.newest = c.PageIndex
+	}
+}
+
+// Recycle implements allocator.Recycle.
+func (pa *pageAffinity) Recycle(minsize int64) (c *cell) {
+	for _, idx := range []int64{pa.last, pa.newest} {
+		pb, ok := pa.pages[idx]
+		if !ok {
+			continue
+		}
+		if c = pb.Recycle(minsize); c.CellState == StateDeleted {
+			pa.all.Restore(c)
+			pa.used(c)
+			return
+		}
+	}
+	if c = pa.all.Recycle(minsize); c.CellState != StateDeleted {
+		return
+	}
+	pa.pages[c.PageIndex].Restore(c)
+	pa.used(c)
+	return
+}
+
+// Restore implements allocator.Restore.
+func (pa *pageAffinity) Restore(c *cell) bool {
+	if !pa.all.Restore(c) {
+		return false
+	}
+	pa.pages[c.PageIndex].Restore(c)
+	if pa.pages[c.PageIndex].Len() == 0 {
+		delete(pa.pages, c.PageIndex)
+	}
+	return true
+}
+
+// Len implements allocator.Len.
+func (pa *pageAffinity) Len() int {
+	return pa.all.Len()
+}
+
+// used records c as last reused cell.
+func (pa *pageAffinity) used(c *cell) {
+	pa.last = c.PageIndex
+	if pa.pages[c.PageIndex].Len() == 0 {
+		delete(pa.pages, c.PageIndex)
+	}
+}
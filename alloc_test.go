@@ -0,0 +1,55 @@
+package flatfile
+
+import (
+	"testing"
+)
+
+func TestAllocators(t *testing.T) {
+
+	makecells := func() []*cell {
+		return []*cell{
+			&cell{CellID: 1, CellState: StateDeleted, PageIndex: 0, Offset: 0, Allocated: 64},
+			&cell{CellID: 2, CellState: StateDeleted, PageIndex: 0, Offset: 100, Allocated: 8},
+			&cell{CellID: 3, CellState: StateDeleted, PageIndex: 1, Offset: 0, Allocated: 512},
+			&cell{CellID: 4, CellState: StateDeleted, PageIndex: 1, Offset: 600, Allocated: 16},
+			&cell{CellID: 5, CellState: StateDeleted, PageIndex: 2, Offset: 0, Allocated: 32},
+			&cell{CellID: 6, CellState: StateDeleted, PageIndex: 2, Offset: 40, Allocated: 16},
+		}
+	}
+
+	tests := []struct {
+		policy AllocPolicy
+		sizes  []int64
+		want   []CellID
+	}{
+		{AllocBestFit, []int64{10, 16, 16, 33, 1000}, []CellID{6, 4, 5, 1, 0}},
+		{AllocFirstFit, []int64{10, 16, 100, 1, 1000}, []CellID{1, 3, 0, 2, 0}},
+		{AllocWorstFit, []int64{1, 1, 100, 32}, []CellID{3, 1, 0, 5}},
+		{AllocSizeClass, []int64{9, 16, 100, 1000}, []CellID{6, 4, 3, 0}},
+		{AllocPageAffinity, []int64{9, 9, 32, 1}, []CellID{6, 5, 1, 2}},
+	}
+
+	for _, test := range tests {
+		a := newAllocator(test.policy)
+		cells := makecells()
+		for _, c := range cells {
+			a.Trash(c)
+		}
+		if a.Len() != len(cells) {
+			t.Fatalf("policy %d: len failed, want %d, got %d", test.policy, len(cells), a.Len())
+		}
+		for i, size := range test.sizes {
+			c := a.Recycle(size)
+			if c.CellID != test.want[i] {
+				t.Fatalf("policy %d: recycle(%d) failed, want cell id %d, got %d",
+					test.policy, size, test.want[i], c.CellID)
+			}
+			if c.CellID == 0 {
+				continue
+			}
+			if a.Restore(c) {
+				t.Fatalf("policy %d: recycled cell %d still in allocator", test.policy, c.CellID)
+			}
+		}
+	}
+}
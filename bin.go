@@ -6,6 +6,8 @@ import (
 
 // bin is a slice of deleted cells.
 // always ordered by cell.Allocated.
+//
+// bin is the best-fit allocator.
 type bin struct {
 	cells   []*cell
 	cellids map[CellID]*cell
@@ -23,22 +25,13 @@ func (b *bin) Trash(c *cell) {
 
 	// TODO Merge adjacent empty cells.
 
-	if len(b.cells) == 0 {
-		b.cells = append(b.cells, c)
-		b.cellids[c.CellID] = c
-		return
-	}
-
 	i := sort.Search(len(b.cells), func(i int) bool {
 		return b.cells[i].Allocated >= c.Allocated
 	})
 
-	ns := append(b.cells[:i], c)
-	if i < len(b.cells) {
-		b.cells = append(ns, b.cells[i+1:]...)
-	} else {
-		b.cells = ns
-	}
+	b.cells = append(b.cells, nil)
+	copy(b.cells[i+1:], b.cells[i:])
+	b.cells[i] = c
 
 	b.cellids[c.CellID] = c
 	return
@@ -54,15 +47,7 @@ func (b *bin) Recycle(minsize int64) (c *cell) {
 	if i >= len(b.cells) || b.cells[i].Allocated < minsize {
 		return &cell{}
 	}
-	c = b.cells[i]
-	b.cells[i] = nil
-	delete(b.cellids, c.CellID)
-	if i == len(b.cells)-1 {
-		b.cells = b.cells[:i]
-	} else {
-		b.cells = append(b.cells[:i], b.cells[i+1:]...)
-	}
-	return
+	return b.remove(i)
 }
 
 // Restore restores a cell from the bin.
@@ -72,19 +57,38 @@ func (b *bin) Restore(c *cell) bool {
 		return false
 	}
 
+	i := b.index(c)
+	if i < 0 {
+		return false
+	}
+	b.remove(i)
+	return true
+}
+
+// Len returns number of cells in the bin.
+func (b *bin) Len() int {
+	return len(b.cells)
+}
+
+// index returns the index of c in b.cells or -1 if not found.
+func (b *bin) index(c *cell) int {
 	i := sort.Search(len(b.cells), func(i int) bool {
 		return b.cells[i].Allocated >= c.Allocated
 	})
-
-	if i >= len(b.cells) || b.cells[i].CellID != c.CellID {
-		return false
+	for ; i < len(b.cells) && b.cells[i].Allocated == c.Allocated; i++ {
+		if b.cells[i].CellID == c.CellID {
+			return i
+		}
 	}
+	return -1
+}
+
+// remove removes a cell at index i from the bin and returns it.
+func (b *bin) remove(i int) (c *cell) {
+	c = b.cells[i]
 	delete(b.cellids, c.CellID)
-	b.cells[i] = nil
-	if i == len(b.cells)-1 {
-		b.cells = b.cells[:i]
-	} else {
-		b.cells = append(b.cells[:i], b.cells[i+1:]...)
-	}
-	return true
+	copy(b.cells[i:], b.cells[i+1:])
+	b.cells[len(b.cells)-1] = nil
+	b.cells = b.cells[:len(b.cells)-1]
+	return
 }
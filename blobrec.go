@@ -0,0 +1,229 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// If StreamRecords option is enabled each blob in a page is stored as a
+// stream record so that the header can be rebuilt from pages alone. A stream
+// record is laid out as, all integers little endian:
+//
+//	offset size   field
+//	0      4      magic, uint32, blobMagic.
+//	4      1      flags, uint8, blobDeleted if the record was deleted.
+//	5      4      crc, uint32, crc32 (IEEE) of bytes from offset 9 to end.
+//	9      8      seq, uint64, sequence number of the write.
+//	17     4      key length, uint32.
+//	21     8      blob length, uint64.
+//	29     klen   key.
+//	29+klen blen  blob.
+//
+// Flags are not covered by crc so that a record can be marked as deleted in
+// place with a single byte write.
+
+const (
+	// blobMagic is the stream record magic number.
+	blobMagic = 0xB10BF147
+	// blobHeaderSize is the size of a stream record without key and blob.
+	blobHeaderSize = 4 + 1 + 4 + 8 + 4 + 8
+	// blobFlagsOffset is the offset of flags in a stream record.
+	blobFlagsOffset = 4
+	// blobDeleted is the stream record deleted flag.
+	blobDeleted = 0x01
+)
+
+// errInvalidBlobRecord is returned when data is not a valid stream record.
+var errInvalidBlobRecord = errors.New("invalid stream record")
+
+// blobRecord is a decoded stream record.
+type blobRecord struct {
+	// offset is the offset of the record in its page.
+	offset int64
+	// size is the size of the whole record.
+	size int64
+	// deleted specifies if the record is marked as deleted.
+	deleted bool
+	// seq is the record sequence number.
+	seq uint64
+	// key is the record key.
+	key []byte
+	// blob is the record blob.
+	blob []byte
+}
+
+// encodeBlobRecord encodes key and blob into a stream record with sequence
+// number seq.
+func encodeBlobRecord(key, blob []byte, seq uint64) []byte {
+	data := make([]byte, blobHeaderSize+len(key)+len(blob))
+	binary.LittleEndian.PutUint32(data[0:4], blobMagic)
+	binary.LittleEndian.PutUint64(data[9:17], seq)
+	binary.LittleEndian.PutUint32(data[17:21], uint32(len(key)))
+	binary.LittleEndian.PutUint64(data[21:29], uint64(len(blob)))
+	copy(data[blobHeaderSize:], key)
+	copy(data[blobHeaderSize+len(key):], blob)
+	binary.LittleEndian.PutUint32(data[5:9], crc32.ChecksumIEEE(data[9:]))
+	return data
+}
+
+// blobRecordSize returns the size of a stream record of data whose first
+// blobHeaderSize bytes are a stream record header. It returns
+// errInvalidBlobRecord if data does not start with a valid record header
+// of a record no bigger than limit.
+func blobRecordSize(data []byte, limit int64) (size int64, err error) {
+	if len(data) < blobHeaderSize || limit < blobHeaderSize ||
+		binary.LittleEndian.Uint32(data[0:4]) != blobMagic {
+		return 0, errInvalidBlobRecord
+	}
+	keylen := uint64(binary.LittleEndian.Uint32(data[17:21]))
+	bloblen := binary.LittleEndian.Uint64(data[21:29])
+	if bloblen > uint64(limit) || keylen+bloblen > uint64(limit)-blobHeaderSize {
+		return 0, errInvalidBlobRecord
+	}
+	return int64(blobHeaderSize + keylen + bloblen), nil
+}
+
+// decodeBlobRecord decodes a stream record from data. If verify, record crc
+// is checked. Returns errInvalidBlobRecord if data is not a valid record or
+// ErrChecksumFailed if crc check failed.
+func decodeBlobRecord(data []byte, verify bool) (rec *blobRecord, err error) {
+	size, err := blobRecordSize(data, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	data = data[:size]
+	if verify && binary.LittleEndian.Uint32(data[5:9]) != crc32.ChecksumIEEE(data[9:]) {
+		return nil, ErrChecksumFailed
+	}
+	keylen := int64(binary.LittleEndian.Uint32(data[17:21]))
+	return &blobRecord{
+		size:    size,
+		deleted: data[blobFlagsOffset]&blobDeleted != 0,
+		seq:     binary.LittleEndian.Uint64(data[9:17]),
+		key:     data[blobHeaderSize : blobHeaderSize+keylen],
+		blob:    data[blobHeaderSize+keylen:],
+	}, nil
+}
+
+// blobScanChunkSize is the size of chunks in which page files are scanned
+// for stream records.
+const blobScanChunkSize = 1 << 20
+
+// scanBlobRecords scans page file filename for valid stream records and
+// calls f for each record found, in order of offset. Record blob is valid
+// only during the call to f.
+func scanBlobRecords(filename string, f func(rec *blobRecord)) (size int64, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size = fi.Size()
+	magic := make([]byte, 4)
+	binary.LittleEndian.PutUint32(magic, blobMagic)
+	buf := make([]byte, blobScanChunkSize)
+	off := int64(0)
+	for off+blobHeaderSize <= size {
+		n, err := file.ReadAt(buf, off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return size, err
+		}
+		i := bytes.Index(buf[:n], magic)
+		if i < 0 {
+			// Magic may span chunks.
+			off += int64(n - len(magic) + 1)
+			continue
+		}
+		pos := off + int64(i)
+		off = pos + 1
+		hdr := make([]byte, blobHeaderSize)
+		if _, err = file.ReadAt(hdr, pos); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return size, err
+		}
+		recsize, err := blobRecordSize(hdr, size-pos)
+		if err != nil {
+			continue
+		}
+		data := make([]byte, recsize)
+		if _, err = file.ReadAt(data, pos); err != nil {
+			return size, err
+		}
+		rec, err := decodeBlobRecord(data, true)
+		if err != nil {
+			continue
+		}
+		rec.offset = pos
+		f(rec)
+		off = pos + recsize
+	}
+	return size, nil
+}
+
+// blobData returns data to be stored in a page for key and val. If
+// StreamRecords is enabled it is a stream record, otherwise val.
+func (ff *FlatFile) blobData(key, val []byte) []byte {
+	if !ff.options.StreamRecords {
+		return val
+	}
+	return encodeBlobRecord(key, val, ff.nextSeq())
+}
+
+// blobValue returns the value under key from page data. If StreamRecords is
+// enabled data is decoded as a stream record, otherwise data is returned.
+func (ff *FlatFile) blobValue(key, data []byte) ([]byte, error) {
+	if !ff.options.StreamRecords {
+		return data, nil
+	}
+	rec, err := decodeBlobRecord(data, ff.options.CRC)
+	if errors.Is(err, errInvalidBlobRecord) {
+		return nil, ErrFlatFile.Errorf("%v: %w", err, ErrCorrupted)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(rec.key, key) {
+		return nil, ErrFlatFile.Errorf("stream record key mismatch: %w", ErrCorrupted)
+	}
+	return rec.blob, nil
+}
+
+// markBlobDeleted marks the stream record of cell c on page p as deleted,
+// if StreamRecords is enabled.
+func (ff *FlatFile) markBlobDeleted(p *page, c *cell) error {
+	if !ff.options.StreamRecords {
+		return nil
+	}
+	if _, err := p.file.WriteAt([]byte{blobDeleted}, c.Offset+blobFlagsOffset); err != nil {
+		return ErrFlatFile.Errorf("page write error: %w", err)
+	}
+	p.dirty = true
+	return nil
+}
+
+// nextSeq returns the next stream record sequence number. Sequence numbers
+// follow wall clock time in nanoseconds and always increase during a
+// session so that they keep increasing across sessions as well.
+func (ff *FlatFile) nextSeq() uint64 {
+	seq := uint64(time.Now().UnixNano())
+	if seq <= ff.seq {
+		seq = ff.seq + 1
+	}
+	ff.seq = seq
+	return seq
+}
@@ -5,8 +5,8 @@
 package flatfile
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/binary"
 	"io"
 
 	"github.com/vedranvuk/binaryex"
@@ -16,9 +16,10 @@ import (
 type CellState uint8
 
 const (
-	StateNormal  CellState = iota // Normal, first-use cell.
-	StateDeleted                  // Cell is marked as deleted, awaits reuse.
-	StateReused                   // Cell is being reused.
+	StateNormal    CellState = iota // Normal, first-use cell.
+	StateDeleted                    // Cell is marked as deleted, awaits reuse.
+	StateReused                     // Cell is being reused.
+	StateReclaimed                  // Cell page was reclaimed, cell is void.
 )
 
 // CellID is the unique cell id.
@@ -47,8 +48,11 @@ type cell struct {
 	// Used specified how much of Allocated is used. Used <= Allocated.
 	Used int64
 
-	// CRC32 is a crc32 checksum of blob data.
-	CRC32 uint32
+	// Checksum is the algorithm of Sum.
+	Checksum ChecksumAlgorithm
+
+	// Sum is the checksum of blob data, nil if blob has no checksum.
+	Sum []byte
 
 	// key is used internally, is the key of a cell, if not deleted.
 	key string
@@ -57,41 +61,188 @@ type cell struct {
 	cache []byte
 }
 
+// Cells are encoded in a layout of cellSize bytes followed by the checksum,
+// all integers little endian:
+//
+//	offset size   field
+//	0      8      CellID, uint64.
+//	8      1      CellState, uint8.
+//	9      8      PageIndex, int64.
+//	17     8      Offset, int64.
+//	25     8      Allocated, int64.
+//	33     8      Used, int64.
+//	41     1      Flags, uint8, cellHasSum if cell has a checksum.
+//	42     1      Checksum algorithm, uint8.
+//	43     1      Checksum length, uint8.
+//	44     len    Checksum.
+//
+// A header cell record payload is the key length as uint32, little endian,
+// followed by the key bytes and the encoded cell. See FORMAT.md.
+
+const (
+	// cellSize is the size of an encoded cell without the checksum.
+	cellSize = 8 + 1 + 8 + 8 + 8 + 8 + 1 + 1 + 1
+	// cellSizeV2 is the size of an encoded cell of format version 2.
+	cellSizeV2 = 8 + 1 + 8 + 8 + 8 + 8 + 4
+	// cellHasSum is the cell flag set if cell has a checksum.
+	cellHasSum = 0x01
+)
+
 // MarshalBinary marshals the cell to a bite slice.
 func (c *cell) MarshalBinary() (data []byte, err error) {
-	buf := bytes.NewBuffer(nil)
-	err = binaryex.WriteStruct(buf, c)
-	return buf.Bytes(), err
+	if len(c.Sum) > maxSumSize {
+		return nil, ErrFlatFile.Errorf("checksum too long")
+	}
+	data = make([]byte, cellSize+len(c.Sum))
+	c.marshalGeometry(data)
+	if c.Sum != nil {
+		data[41] = cellHasSum
+	}
+	data[42] = byte(c.Checksum)
+	data[43] = byte(len(c.Sum))
+	copy(data[cellSize:], c.Sum)
+	return data, nil
 }
 
 // UnmarshalBinary unmarshals a cell from a bite slice.
 func (c *cell) UnmarshalBinary(data []byte) error {
-	return binaryex.ReadStruct(bytes.NewBuffer(data), c)
+	if len(data) < cellSize || len(data) != cellSize+int(data[43]) {
+		return ErrFlatFile.Errorf("invalid cell size %d: %w", len(data), ErrCorrupted)
+	}
+	c.unmarshalGeometry(data)
+	c.clearSum()
+	if data[41]&cellHasSum != 0 {
+		c.Checksum = ChecksumAlgorithm(data[42])
+		c.Sum = append([]byte{}, data[cellSize:]...)
+	}
+	return nil
 }
 
-// write writes the cell to writer w under specified key.
-func (c *cell) write(w io.Writer, key string) (err error) {
-	var buffer []byte
-	writer := bufio.NewWriter(w)
-	err = binaryex.WriteString(writer, key)
-	if err == nil {
-		buffer, err = c.MarshalBinary()
-	}
-	if err == nil {
-		binaryex.WriteNumber(writer, len(buffer))
+// marshalGeometry marshals cell fields common to all fixed layout format
+// versions to data.
+func (c *cell) marshalGeometry(data []byte) {
+	binary.LittleEndian.PutUint64(data[0:8], uint64(c.CellID))
+	data[8] = byte(c.CellState)
+	binary.LittleEndian.PutUint64(data[9:17], uint64(c.PageIndex))
+	binary.LittleEndian.PutUint64(data[17:25], uint64(c.Offset))
+	binary.LittleEndian.PutUint64(data[25:33], uint64(c.Allocated))
+	binary.LittleEndian.PutUint64(data[33:41], uint64(c.Used))
+}
+
+// unmarshalGeometry unmarshals cell fields common to all fixed layout
+// format versions from data.
+func (c *cell) unmarshalGeometry(data []byte) {
+	c.CellID = CellID(binary.LittleEndian.Uint64(data[0:8]))
+	c.CellState = CellState(data[8])
+	c.PageIndex = int64(binary.LittleEndian.Uint64(data[9:17]))
+	c.Offset = int64(binary.LittleEndian.Uint64(data[17:25]))
+	c.Allocated = int64(binary.LittleEndian.Uint64(data[25:33]))
+	c.Used = int64(binary.LittleEndian.Uint64(data[33:41]))
+}
+
+// unmarshalV2 unmarshals a cell encoded by format version 2 from a bite
+// slice.
+func (c *cell) unmarshalV2(data []byte) error {
+	if len(data) != cellSizeV2 {
+		return ErrFlatFile.Errorf("invalid cell size %d: %w", len(data), ErrCorrupted)
 	}
-	if err == nil {
-		_, err = writer.Write(buffer)
+	c.unmarshalGeometry(data)
+	c.setLegacySum(binary.LittleEndian.Uint32(data[41:45]))
+	return nil
+}
+
+// legacyCell is the layout of a cell of format versions 0 and 1.
+type legacyCell struct {
+	CellID
+	CellState
+	PageIndex int64
+	Offset    int64
+	Allocated int64
+	Used      int64
+	CRC32     uint32
+}
+
+// unmarshalLegacy unmarshals a cell encoded by format versions 0 and 1
+// from a bite slice.
+func (c *cell) unmarshalLegacy(data []byte) error {
+	lc := &legacyCell{}
+	if err := binaryex.ReadStruct(bytes.NewBuffer(data), lc); err != nil {
+		return err
 	}
-	if err == nil {
-		err = writer.Flush()
+	c.CellID = lc.CellID
+	c.CellState = lc.CellState
+	c.PageIndex = lc.PageIndex
+	c.Offset = lc.Offset
+	c.Allocated = lc.Allocated
+	c.Used = lc.Used
+	c.setLegacySum(lc.CRC32)
+	return nil
+}
+
+// setLegacySum sets cell checksum from a crc32 checksum of format versions
+// before 3 where 0 meant no checksum.
+func (c *cell) setLegacySum(crc uint32) {
+	c.clearSum()
+	if crc != 0 {
+		c.Checksum = ChecksumCRC32
+		c.Sum = make([]byte, 4)
+		binary.BigEndian.PutUint32(c.Sum, crc)
 	}
+}
+
+// write writes the cell to writer w under specified key as a header record.
+func (c *cell) write(w io.Writer, key string) (err error) {
+	data, err := c.MarshalBinary()
 	if err != nil {
+		return
+	}
+	payload := make([]byte, 4+len(key)+len(data))
+	binary.LittleEndian.PutUint32(payload[0:4], uint32(len(key)))
+	copy(payload[4:], key)
+	copy(payload[4+len(key):], data)
+	if err = writeRecord(w, recordCell, payload); err != nil {
 		return ErrFlatFile.Errorf("cell write error: %w", err)
 	}
 	return
 }
 
+// read reads the cell and its key from a header record payload encoded in
+// specified format version.
+func (c *cell) read(payload []byte, version int) (err error) {
+	if version < 2 {
+		return c.readLegacy(payload)
+	}
+	unmarshal := c.UnmarshalBinary
+	if version == 2 {
+		unmarshal = c.unmarshalV2
+	}
+	if len(payload) < 4 {
+		return ErrFlatFile.Errorf("cell key read error: %w", ErrCorrupted)
+	}
+	keylen := int64(binary.LittleEndian.Uint32(payload[0:4]))
+	if keylen > int64(len(payload)-4) {
+		return ErrFlatFile.Errorf("invalid cell key length %d: %w", keylen, ErrCorrupted)
+	}
+	c.key = string(payload[4 : 4+keylen])
+	if err = unmarshal(payload[4+keylen:]); err != nil {
+		return ErrFlatFile.Errorf("cell read error: %w", err)
+	}
+	return
+}
+
+// readLegacy reads the cell and its key from a header record payload of
+// format version 1.
+func (c *cell) readLegacy(payload []byte) (err error) {
+	buf := bytes.NewBuffer(payload)
+	if err = binaryex.ReadString(buf, &c.key); err != nil {
+		return ErrFlatFile.Errorf("cell key read error: %w", err)
+	}
+	if err = c.unmarshalLegacy(buf.Bytes()); err != nil {
+		return ErrFlatFile.Errorf("cell read error: %w", err)
+	}
+	return
+}
+
 // BlobEndPos returns cell blob end position in the stream.
 func (c *cell) BlobEndPos() int64 {
 	return c.Offset + c.Allocated
@@ -1,6 +1,8 @@
 package flatfile
 
 import (
+	"bytes"
+	"errors"
 	"reflect"
 	"testing"
 )
@@ -15,7 +17,8 @@ func TestCell(t *testing.T) {
 			Offset:    69,
 			Allocated: 9001,
 			Used:      64,
-			CRC32:     80085,
+			Checksum:  ChecksumCRC32C,
+			Sum:       []byte{0, 0, 0, 0},
 			key:       "mykey",
 			cache:     []byte{0x1, 0x2, 0x3, 0x4, 0x5},
 		}
@@ -34,4 +37,45 @@ func TestCell(t *testing.T) {
 	if !reflect.DeepEqual(c, makecell()) {
 		t.Fatalf("cell marshaling failed, want:\n%#v\ngot:\n%#v\n", c, makecell())
 	}
+
+	// Encoding is fixed layout, little endian. A zero checksum is present.
+	want := []byte{
+		0x39, 0x05, 0, 0, 0, 0, 0, 0, // CellID
+		0x02,                      // CellState
+		0x2A, 0, 0, 0, 0, 0, 0, 0, // PageIndex
+		0x45, 0, 0, 0, 0, 0, 0, 0, // Offset
+		0x29, 0x23, 0, 0, 0, 0, 0, 0, // Allocated
+		0x40, 0, 0, 0, 0, 0, 0, 0, // Used
+		0x01,       // Flags
+		0x01,       // Checksum
+		0x04,       // Checksum length
+		0, 0, 0, 0, // Sum
+	}
+	if !bytes.Equal(bin, want) {
+		t.Fatalf("cell encoding failed, want:\n%x\ngot:\n%x\n", want, bin)
+	}
+	if err := c.UnmarshalBinary(bin[:len(bin)-1]); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("short cell failed, want ErrCorrupted, got %v", err)
+	}
+
+	// No checksum.
+	c.clearSum()
+	if bin, err = c.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+	if len(bin) != cellSize || bin[41] != 0 {
+		t.Fatalf("cell encoding failed, want no checksum, got %x", bin)
+	}
+
+	// Format version 2 crc32 becomes a crc32 checksum, 0 means none.
+	v2 := append(want[:41:41], 0xD5, 0x38, 0x01, 0x00)
+	if err := c.unmarshalV2(v2); err != nil {
+		t.Fatal(err)
+	}
+	if c.Checksum != ChecksumCRC32 || !bytes.Equal(c.Sum, []byte{0x00, 0x01, 0x38, 0xD5}) {
+		t.Fatalf("v2 cell failed, got %v %x", c.Checksum, c.Sum)
+	}
+	if err := c.unmarshalV2(append(want[:41:41], 0, 0, 0, 0)); err != nil || c.Sum != nil {
+		t.Fatalf("v2 cell failed, want no checksum, got %x %v", c.Sum, err)
+	}
 }
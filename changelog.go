@@ -0,0 +1,450 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The changelog is a durable log of Put, Modify and Delete events kept in a
+// .changelog file if Changelog option is enabled, for consumers that read
+// it incrementally with ChangesSince. It consists of the changelog
+// signature, a version record and change records, see record.go. It is
+// kept apart from the header, so neither header compaction nor
+// checkpoints discard changes.
+//
+// A change is appended after its operation is applied and is made durable
+// with it: on each write if SyncWrites is enabled, on commit otherwise.
+// Journal entries carry the event sequence number of their operation, so
+// operations replayed on Open that the changelog does not hold yet are
+// logged again and no change is lost after a crash if the journal is
+// enabled.
+//
+// Changes are trimmed by ChangelogSize and ChangelogAge. Trimming rewrites
+// the changelog once it holds twice the retention so changes inside the
+// retention are never discarded. The last change is always kept to carry
+// the sequence number over to the next session.
+//
+// A session that does not enable the changelog does not log its changes.
+// It replaces an existing changelog with a sync record holding a sequence
+// number reserved for the changes it does not log, so that the next
+// session continues after it and consumers of earlier changes get
+// ErrChangesTrimmed.
+
+// chgsig is the .changelog signature.
+var chgsig = []byte{0xF1, 0x47, 0xC1, 0x01}
+
+// changeSize is the size of a change record payload without the key.
+const changeSize = 8 + 8 + 1
+
+// change is a logged event.
+type change struct {
+	// seq is the event sequence number.
+	seq uint64
+	// time is the time the change was logged in unix nanoseconds.
+	time int64
+	// op is the operation.
+	op journalOp
+	// key is the written key.
+	key []byte
+}
+
+// marshal marshals the change to a change record payload laid out as, all
+// integers little endian: seq uint64, time int64, op uint8, key.
+func (c *change) marshal() []byte {
+	data := make([]byte, changeSize, changeSize+len(c.key))
+	binary.LittleEndian.PutUint64(data[0:8], c.seq)
+	binary.LittleEndian.PutUint64(data[8:16], uint64(c.time))
+	data[16] = byte(c.op)
+	return append(data, c.key...)
+}
+
+// unmarshal unmarshals the change from a change record payload.
+func (c *change) unmarshal(data []byte) error {
+	if len(data) < changeSize {
+		return ErrFlatFile.Errorf("invalid change size: %w", ErrCorrupted)
+	}
+	c.seq = binary.LittleEndian.Uint64(data[0:8])
+	c.time = int64(binary.LittleEndian.Uint64(data[8:16]))
+	c.op = journalOp(data[16])
+	c.key = data[changeSize:]
+	if c.op < journalPut || c.op > journalDelete {
+		return ErrFlatFile.Errorf("invalid change op %d: %w", c.op, ErrCorrupted)
+	}
+	return nil
+}
+
+// size returns the size of the change record.
+func (c *change) size() int64 {
+	return int64(recordFrameSize + changeSize + len(c.key))
+}
+
+// changelog is the durable changelog.
+type changelog struct {
+	// filename is the changelog filename.
+	filename string
+	// file is the changelog file.
+	file *os.File
+	// sync specifies if file is opened for synchronous writes.
+	sync bool
+	// size is the size of the changelog file.
+	size int64
+	// first is the first change, nil if empty.
+	first *change
+	// last is the sequence number of the last change.
+	last uint64
+	// maxSize and maxAge are retention limits, unlimited if <= 0.
+	maxSize int64
+	maxAge  time.Duration
+}
+
+// openChangelog opens or creates the changelog file filename. A torn last
+// record is truncated.
+func openChangelog(filename string, sync bool) (*changelog, error) {
+	cl := &changelog{filename: filename, sync: sync}
+	if err := cl.open(); err != nil {
+		return nil, err
+	}
+	fi, err := cl.file.Stat()
+	if err != nil {
+		cl.file.Close()
+		return nil, ErrFlatFile.Errorf("changelog stat error: %w", err)
+	}
+	if fi.Size() == 0 {
+		if err = cl.write(cl.file, 0, nil); err != nil {
+			cl.file.Close()
+			return nil, err
+		}
+		return cl, nil
+	}
+	changes, mark, end, err := readChanges(cl.file)
+	if err != nil {
+		cl.file.Close()
+		return nil, err
+	}
+	if end < fi.Size() {
+		if err = cl.file.Truncate(end); err != nil {
+			cl.file.Close()
+			return nil, ErrFlatFile.Errorf("changelog truncate error: %w", err)
+		}
+	}
+	cl.size = end
+	cl.last = mark
+	if len(changes) > 0 {
+		cl.first = changes[0]
+		cl.last = changes[len(changes)-1].seq
+	}
+	return cl, nil
+}
+
+// open opens the changelog file.
+func (cl *changelog) open() (err error) {
+	opt := os.O_CREATE | os.O_RDWR
+	if cl.sync {
+		opt = opt | os.O_SYNC
+	}
+	if cl.file, err = os.OpenFile(cl.filename, opt, os.ModePerm); err != nil {
+		return ErrFlatFile.Errorf("changelog open error: %w", err)
+	}
+	return nil
+}
+
+// readChanges reads changes from changelog file up to a torn last record,
+// if any. Returns the changes, the sequence number of the sync record, 0
+// if none, and the offset past the last record.
+func readChanges(file *os.File) (changes []*change, mark uint64, end int64, err error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, 0, 0, ErrFlatFile.Errorf("changelog stat error: %w", err)
+	}
+	buf := make([]byte, len(chgsig))
+	if _, err = file.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, chgsig) {
+		return nil, 0, 0, ErrFlatFile.Errorf("invalid changelog signature: %w", ErrCorrupted)
+	}
+	if _, err = file.Seek(int64(len(chgsig)), os.SEEK_SET); err != nil {
+		return nil, 0, 0, ErrFlatFile.Errorf("changelog seek error: %w", err)
+	}
+	rr := newRecordReader(file, int64(len(chgsig)), fi.Size())
+	for {
+		off := rr.Offset()
+		typ, payload, err := rr.Next()
+		if errors.Is(err, io.EOF) || errors.Is(err, errTornRecord) {
+			return changes, mark, off, nil
+		}
+		if err != nil {
+			return nil, 0, 0, ErrFlatFile.Errorf("changelog read error: %w", err)
+		}
+		switch typ {
+		case recordVersion:
+			if len(payload) != 2 {
+				return nil, 0, 0, ErrFlatFile.Errorf("invalid changelog version: %w", ErrCorrupted)
+			}
+			if err = checkVersion(int(binary.LittleEndian.Uint16(payload))); err != nil {
+				return nil, 0, 0, err
+			}
+		case recordSync:
+			if len(payload) != 8 {
+				return nil, 0, 0, ErrFlatFile.Errorf("invalid changelog sync: %w", ErrCorrupted)
+			}
+			mark = binary.LittleEndian.Uint64(payload)
+		case recordChange:
+			c := &change{}
+			if err = c.unmarshal(payload); err != nil {
+				return nil, 0, 0, err
+			}
+			changes = append(changes, c)
+		default:
+			return nil, 0, 0, ErrFlatFile.Errorf(
+				"changelog record at offset %d: unknown type %d: %w", off, typ, ErrCorrupted)
+		}
+	}
+}
+
+// write writes the signature, a sync record with sequence number mark if
+// mark > 0, and changes to the start of file and sets the changelog size.
+func (cl *changelog) write(file *os.File, mark uint64, changes []*change) error {
+	buf := bytes.NewBuffer(nil)
+	if err := writeVersioned(buf, chgsig); err != nil {
+		return ErrFlatFile.Errorf("changelog write error: %w", err)
+	}
+	if mark > 0 {
+		var payload [8]byte
+		binary.LittleEndian.PutUint64(payload[:], mark)
+		if err := writeRecord(buf, recordSync, payload[:]); err != nil {
+			return ErrFlatFile.Errorf("changelog write error: %w", err)
+		}
+	}
+	for _, c := range changes {
+		if err := writeRecord(buf, recordChange, c.marshal()); err != nil {
+			return ErrFlatFile.Errorf("changelog write error: %w", err)
+		}
+	}
+	if _, err := file.WriteAt(buf.Bytes(), 0); err != nil {
+		return ErrFlatFile.Errorf("changelog write error: %w", err)
+	}
+	cl.size = int64(buf.Len())
+	return nil
+}
+
+// Append appends a change of operation op on key with sequence number seq
+// and trims the changelog if it holds twice the retention.
+func (cl *changelog) Append(seq uint64, op journalOp, key []byte) error {
+	c := &change{seq: seq, time: time.Now().UnixNano(), op: op, key: key}
+	buf := bytes.NewBuffer(nil)
+	if err := writeRecord(buf, recordChange, c.marshal()); err != nil {
+		return ErrFlatFile.Errorf("changelog write error: %w", err)
+	}
+	if _, err := cl.file.WriteAt(buf.Bytes(), cl.size); err != nil {
+		return ErrFlatFile.Errorf("changelog write error: %w", err)
+	}
+	cl.size += int64(buf.Len())
+	cl.last = seq
+	if cl.first == nil {
+		cl.first = &change{seq: c.seq, time: c.time, op: c.op}
+	}
+	if (cl.maxSize > 0 && cl.size > 2*cl.maxSize) ||
+		(cl.maxAge > 0 && time.Duration(c.time-cl.first.time) > 2*cl.maxAge) {
+		return cl.trim(c.time)
+	}
+	return nil
+}
+
+// trim rewrites the changelog to hold only changes inside the retention as
+// of now, and at least the last change.
+func (cl *changelog) trim(now int64) error {
+	changes, _, _, err := readChanges(cl.file)
+	if err != nil {
+		return err
+	}
+	keep, size := len(changes)-1, changes[len(changes)-1].size()
+	for keep > 0 {
+		c := changes[keep-1]
+		if cl.maxSize > 0 && size+c.size() > cl.maxSize {
+			break
+		}
+		if cl.maxAge > 0 && time.Duration(now-c.time) > cl.maxAge {
+			break
+		}
+		size += c.size()
+		keep--
+	}
+	changes = changes[keep:]
+	if err = cl.rewrite(0, changes); err != nil {
+		return ErrFlatFile.Errorf("changelog trim error: %w", err)
+	}
+	cl.first = changes[0]
+	cl.first.key = nil
+	return nil
+}
+
+// Skip replaces the changelog with a sync record that reserves the next
+// sequence number for changes that are not logged.
+func (cl *changelog) Skip() error {
+	if err := cl.rewrite(cl.last+1, nil); err != nil {
+		return ErrFlatFile.Errorf("changelog skip error: %w", err)
+	}
+	cl.last++
+	cl.first = nil
+	return nil
+}
+
+// rewrite atomically replaces the changelog file with one holding a sync
+// record with sequence number mark, if mark > 0, and changes, then reopens
+// it.
+func (cl *changelog) rewrite(mark uint64, changes []*change) error {
+	tmpname := cl.filename + ".tmp"
+	file, err := os.OpenFile(tmpname, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	if err = cl.write(file, mark, changes); err == nil {
+		err = file.Sync()
+	}
+	if errc := file.Close(); err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = os.Rename(tmpname, cl.filename)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	syncDir(filepath.Dir(cl.filename))
+	cl.file.Close()
+	return cl.open()
+}
+
+// Sync commits the changelog file to stable storage.
+func (cl *changelog) Sync() error {
+	if err := cl.file.Sync(); err != nil {
+		return ErrFlatFile.Errorf("changelog sync error: %w", err)
+	}
+	return nil
+}
+
+// Close closes the changelog file.
+func (cl *changelog) Close() error {
+	return cl.file.Close()
+}
+
+// changelogName returns the changelog filename of the FlatFile.
+func (ff *FlatFile) changelogName() string {
+	return fmt.Sprintf("%s.%s", filepath.Join(ff.filename, filepath.Base(ff.filename)), ChangelogExt)
+}
+
+// openChangelog opens the changelog of the FlatFile and continues event
+// sequence numbers from its last change.
+func (ff *FlatFile) openChangelog() error {
+	cl, err := openChangelog(ff.changelogName(), ff.options.SyncWrites)
+	if err != nil {
+		return err
+	}
+	cl.maxSize = ff.options.ChangelogSize
+	cl.maxAge = ff.options.ChangelogAge
+	if cl.last > ff.events {
+		ff.events = cl.last
+	}
+	ff.changelog = cl
+	return nil
+}
+
+// skipChangelog marks the changelog of the FlatFile left by a session that
+// enabled it, if any, as missing the changes of this session.
+func (ff *FlatFile) skipChangelog() error {
+	exists, err := FileExists(ff.changelogName())
+	if err != nil {
+		return ErrFlatFile.Errorf("changelog stat error: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+	cl, err := openChangelog(ff.changelogName(), ff.options.SyncWrites)
+	if err != nil {
+		return err
+	}
+	if err = cl.Skip(); err != nil {
+		cl.Close()
+		return err
+	}
+	if err = cl.Close(); err != nil {
+		return ErrFlatFile.Errorf("changelog close error: %w", err)
+	}
+	return nil
+}
+
+// logChange assigns the next event sequence number to operation op on key
+// and logs it to the changelog, if enabled. The sequence number is
+// assigned only if the change is written, so that changes logged have no
+// gaps. Returns the sequence number, 0 if not assigned. Must be called
+// with the write lock held.
+func (ff *FlatFile) logChange(op journalOp, key []byte) (uint64, error) {
+	seq := ff.events + 1
+	if ff.changelog != nil {
+		err := ff.changelog.Append(seq, op, key)
+		if ff.changelog.last != seq {
+			return 0, err
+		}
+		ff.events = seq
+		return seq, err
+	}
+	ff.events = seq
+	return seq, nil
+}
+
+// ChangesSince returns changes logged after the change with sequence
+// number seq, in order, as events without values; Get returns current
+// values. Pass the Seq of the last event received to resume, or 0 to read
+// from the oldest retained change. Returns ErrChangesTrimmed if seq is not
+// 0 and changes after seq were trimmed by retention or not logged by a
+// session that did not enable Changelog, in which case the consumer should
+// rescan the FlatFile and resume from the Seq of the last returned change.
+//
+// Returns ErrNotSupported if Changelog is not enabled. A FlatFile opened
+// read-only or with OpenFollower with Changelog enabled reads the changelog
+// of its writer.
+func (ff *FlatFile) ChangesSince(seq uint64) ([]Event, error) {
+	if !ff.options.Changelog {
+		return nil, ErrNotSupported
+	}
+
+	ff.mutex.RLock()
+	defer ff.mutex.RUnlock()
+
+	file, err := os.Open(ff.changelogName())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, ErrFlatFile.Errorf("changelog open error: %w", err)
+	}
+	defer file.Close()
+	changes, mark, _, err := readChanges(file)
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	for _, c := range changes {
+		if c.seq <= seq {
+			continue
+		}
+		events = append(events, Event{Seq: c.seq, Op: Op(c.op), Key: c.key})
+	}
+	oldest := mark + 1
+	if len(changes) > 0 {
+		oldest = changes[0].seq
+	}
+	if seq > 0 && oldest > seq+1 {
+		return events, ErrChangesTrimmed
+	}
+	return events, nil
+}
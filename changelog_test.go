@@ -0,0 +1,247 @@
+package flatfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestChangelog(t *testing.T) {
+
+	testdir := "test/changelog"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.Changelog = true
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := ff.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ff.Delete([]byte("key0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resume after restart, sequence numbers continue.
+	ff, err = Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Modify([]byte("key1"), []byte("mod")); err != nil {
+		t.Fatal(err)
+	}
+	events, err := ff.ChangesSince(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("want 3 changes, got %d", len(events))
+	}
+	if e := events[1]; e.Seq != 11 || e.Op != OpDelete || string(e.Key) != "key0" {
+		t.Fatalf("unexpected change %+v", e)
+	}
+	if e := events[2]; e.Seq != 12 || e.Op != OpModify || string(e.Key) != "key1" {
+		t.Fatalf("unexpected change %+v", e)
+	}
+	if events, err = ff.ChangesSince(12); err != nil || len(events) != 0 {
+		t.Fatalf("want no changes, got %d (%v)", len(events), err)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangelogRetention(t *testing.T) {
+
+	testdir := "test/changelogretention"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	key := []byte("key")
+	size := (&change{key: key}).size()
+	options := NewOptions()
+	options.Changelog = true
+	options.ChangelogSize = 10 * size
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	if err := ff.Put(key, []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 100; i++ {
+		if err := ff.Modify(key, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Retention holds at least the last 10 changes, at most twice that.
+	events, err := ff.ChangesSince(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) < 10 || len(events) > 20 || events[len(events)-1].Seq != 100 {
+		t.Fatalf("unexpected retained changes, %d", len(events))
+	}
+	if events, err = ff.ChangesSince(90); err != nil || len(events) != 10 {
+		t.Fatalf("want 10 changes inside retention, got %d (%v)", len(events), err)
+	}
+	if _, err = ff.ChangesSince(1); !errors.Is(err, ErrChangesTrimmed) {
+		t.Fatalf("want ErrChangesTrimmed, got %v", err)
+	}
+}
+
+func TestChangelogReplay(t *testing.T) {
+
+	testdir := "test/changelogreplay"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.Changelog = true
+	options.UseJournal = true
+	options.PersistentHeader = false
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := ff.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Crash before the last change reached the changelog.
+	ff.header.file.Close()
+	ff.stream.Close()
+	ff.journal.Close()
+	ff.changelog.Close()
+	ff.unlock()
+	last := (&change{key: []byte("key9")}).size()
+	fn := ff.changelogName()
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(fn, fi.Size()-last); err != nil {
+		t.Fatal(err)
+	}
+
+	ff, err = Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	events, err := ff.ChangesSince(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 10 {
+		t.Fatalf("want 10 changes after replay, got %d", len(events))
+	}
+	for i, e := range events {
+		if e.Seq != uint64(i+1) || string(e.Key) != fmt.Sprintf("key%d", i) {
+			t.Fatalf("unexpected change %d: %+v", i, e)
+		}
+	}
+}
+
+func TestChangelogSkip(t *testing.T) {
+
+	testdir := "test/changelogskip"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	open := func(changelog bool) *FlatFile {
+		options := NewOptions()
+		options.Changelog = changelog
+		ff, err := Open(testdir, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ff
+	}
+	ff := open(true)
+	for i := 0; i < 3; i++ {
+		if err := ff.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A session without the changelog is not logged.
+	ff = open(false)
+	if err := ff.Put([]byte("key3"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ff = open(true)
+	defer ff.Close()
+	if _, err := ff.ChangesSince(3); !errors.Is(err, ErrChangesTrimmed) {
+		t.Fatalf("want ErrChangesTrimmed, got %v", err)
+	}
+	if err := ff.Put([]byte("key4"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	events, err := ff.ChangesSince(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Seq != 5 || string(events[0].Key) != "key4" {
+		t.Fatalf("unexpected changes %+v", events)
+	}
+	if _, err := ff.ChangesSince(3); !errors.Is(err, ErrChangesTrimmed) {
+		t.Fatalf("want ErrChangesTrimmed, got %v", err)
+	}
+}
+
+func TestChangelogAppendError(t *testing.T) {
+
+	testdir := "test/changelogappenderror"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.Changelog = true
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	if err := ff.Put([]byte("key0"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A change that is not logged does not take a sequence number.
+	ff.changelog.file.Close()
+	if err := ff.Put([]byte("key1"), []byte("val")); err == nil {
+		t.Fatal("want changelog error")
+	}
+	if err := ff.changelog.open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Put([]byte("key2"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	events, err := ff.ChangesSince(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Seq != 2 || string(events[0].Key) != "key2" {
+		t.Fatalf("unexpected changes %+v", events)
+	}
+}
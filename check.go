@@ -0,0 +1,543 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// quarantineLog is the name of the file in QuarantineDir that describes
+// quarantined cells, one per line as tab separated cell id, page index,
+// offset, used size and quoted key.
+const quarantineLog = "quarantine.log"
+
+// Problem describes an inconsistency found by Check.
+type Problem struct {
+	// Cell is the ID of the affected cell, 0 if the problem is not specific
+	// to a cell.
+	Cell CellID
+	// Key is the key of the affected cell, if any.
+	Key string
+	// Page is the index of the affected page, -1 if the problem is not
+	// specific to a page.
+	Page int64
+	// Err describes the problem.
+	Err error
+}
+
+// String implements fmt.Stringer.
+func (p Problem) String() string {
+	sb := strings.Builder{}
+	if p.Page >= 0 {
+		fmt.Fprintf(&sb, "page %d: ", p.Page)
+	}
+	if p.Cell != 0 {
+		fmt.Fprintf(&sb, "cell %d", p.Cell)
+		if p.Key != "" {
+			fmt.Fprintf(&sb, " (key %q)", p.Key)
+		}
+		sb.WriteString(": ")
+	}
+	sb.WriteString(p.Err.Error())
+	return sb.String()
+}
+
+// CheckReport is the result of Check or Repair.
+type CheckReport struct {
+	// Cells is the number of cells checked.
+	Cells int
+	// Keys is the number of valid keys.
+	Keys int
+	// Pages is the number of page files found.
+	Pages int
+	// Problems are the problems found.
+	Problems []Problem
+	// Repaired specifies if problems were repaired.
+	Repaired bool
+	// Quarantined is the number of cells and pages moved to quarantine
+	// by repair.
+	Quarantined int
+}
+
+// OK returns truth if no problems were found.
+func (cr *CheckReport) OK() bool {
+	return len(cr.Problems) == 0
+}
+
+// String implements fmt.Stringer.
+func (cr *CheckReport) String() string {
+	sb := strings.Builder{}
+	for _, p := range cr.Problems {
+		sb.WriteString(p.String())
+		sb.WriteByte('\n')
+	}
+	fmt.Fprintf(&sb, "%d cells, %d keys, %d pages, %d problems",
+		cr.Cells, cr.Keys, cr.Pages, len(cr.Problems))
+	if cr.Repaired {
+		fmt.Fprintf(&sb, ", repaired, %d quarantined", cr.Quarantined)
+	}
+	return sb.String()
+}
+
+// Check checks the FlatFile in base directory filename for consistency
+// and returns a report. FlatFile must not be open for writing, otherwise an
+// error that wraps ErrLocked is returned. Check validates the header
+// signature and records, checks that cells lie within their page files, do
+// not overlap and that their blobs pass checksums, and looks for duplicate
+// keys and page files not used by any cell. Damaged header records are
+// reported and skipped, records that follow them are still read.
+//
+// A duplicate key is left by a relocate interrupted before the old cell
+// was deleted. It is not corruption; Open and Repair keep the cell with the
+// higher CellID. It is reported with an error that wraps ErrDuplicateKey.
+//
+// Returns an error if the FlatFile could not be checked. Problems found are
+// not errors and are returned in the report.
+func Check(filename string) (*CheckReport, error) {
+	return check(filename, false)
+}
+
+// Repair checks the FlatFile in base directory filename like Check, then
+// repairs problems found. Cells whose blobs are damaged or missing and
+// page files not used by any cell are moved to QuarantineDir in the base
+// directory, except if damaged header records were skipped, as cells they
+// held may have used those pages. Header is rewritten to hold only
+// consistent cells, cells of skipped records are lost. FlatFile must not
+// be open.
+//
+// Returns the report of the check and repair or an error if one occurs.
+func Repair(filename string) (*CheckReport, error) {
+	return check(filename, true)
+}
+
+// check implements Check and Repair.
+func check(filename string, repair bool) (*CheckReport, error) {
+	bn := filepath.Base(filename)
+	if bn == "." || bn == "/" {
+		return nil, ErrFlatFile.Errorf("invalid filename: '%s'", filename)
+	}
+	base := filepath.Join(filename, bn)
+	lock, err := lockFile(fmt.Sprintf("%s.%s", base, LockExt), repair)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	report := &CheckReport{}
+	problem := func(c *cell, pageidx int64, err error) {
+		p := Problem{Page: pageidx, Err: err}
+		if c != nil {
+			p.Cell = c.CellID
+			p.Key = c.key
+		}
+		report.Problems = append(report.Problems, p)
+	}
+	// Load options.
+	options := NewOptions()
+	data, err := readFileIfExists(fmt.Sprintf("%s.%s", base, OptionsExt))
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		if err = options.Unmarshal(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	}
+	// Read header. Damaged records are skipped, cells they held are lost.
+	skipped := 0
+	h := newHeader(fmt.Sprintf("%s.%s", base, HeaderExt))
+	h.cells = newPot()
+	for _, fn := range []string{h.checkpoint, h.filename} {
+		exists, err := FileExists(fn)
+		if err != nil {
+			return nil, ErrFlatFile.Errorf("header stat error: %w", err)
+		}
+		if !exists {
+			continue
+		}
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, ErrFlatFile.Errorf("header read error: %w", err)
+		}
+		tornat, version, damaged, err := h.salvage(data)
+		if err == nil {
+			err = checkVersion(version)
+			if errors.Is(err, ErrFormatVersion) {
+				return nil, err
+			}
+		}
+		if err != nil {
+			problem(nil, -1, ErrFlatFile.Errorf("'%s': %w", filepath.Base(fn), err))
+		}
+		for _, off := range damaged {
+			problem(nil, -1, ErrFlatFile.Errorf("'%s': record at offset %d: damaged, skipped: %w",
+				filepath.Base(fn), off, ErrCorrupted))
+		}
+		skipped += len(damaged)
+		if tornat >= 0 {
+			problem(nil, -1, ErrFlatFile.Errorf("'%s': record at offset %d: incomplete: %w",
+				filepath.Base(fn), tornat, ErrCorrupted))
+		}
+	}
+	// Find page files.
+	pages, err := findPages(base)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[int64]int64)
+	for _, pageidx := range pages {
+		fi, err := os.Stat(fmt.Sprintf("%s.%.4d.%s", base, pageidx, StreamExt))
+		if err != nil {
+			return nil, ErrFlatFile.Errorf("page stat error: %w", err)
+		}
+		sizes[pageidx] = fi.Size()
+	}
+	report.Pages = len(pages)
+	// Collect cells, void reclaimed ones.
+	cells := make([]*cell, 0, len(h.cells.cells))
+	for _, c := range h.cells.cells {
+		if c.CellState == StateReclaimed {
+			continue
+		}
+		cells = append(cells, c)
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].PageIndex != cells[j].PageIndex {
+			return cells[i].PageIndex < cells[j].PageIndex
+		}
+		if cells[i].Offset != cells[j].Offset {
+			return cells[i].Offset < cells[j].Offset
+		}
+		return cells[i].CellID < cells[j].CellID
+	})
+	report.Cells = len(cells)
+	live := func(c *cell) bool {
+		return c.CellState == StateNormal || c.CellState == StateReused
+	}
+	// Map keys, find duplicates.
+	keys := make(map[string]*cell)
+	for _, c := range cells {
+		if !live(c) {
+			continue
+		}
+		prev, ok := keys[c.key]
+		if !ok {
+			keys[c.key] = c
+			continue
+		}
+		loser := prev
+		if c.CellID < prev.CellID {
+			loser = c
+		} else {
+			keys[c.key] = c
+		}
+		// Left by an interrupted relocate; Open resolves it the same way.
+		problem(loser, loser.PageIndex, ErrFlatFile.Errorf(
+			"superseded by cell %d, deleted on open: %w", keys[c.key].CellID, ErrDuplicateKey))
+		loser.key = ""
+		loser.clearSum()
+		loser.CellState = StateDeleted
+	}
+	// Check cell geometry and blobs. Cells in bad are quarantined and
+	// destroyed on repair, unless their space is valid in which case they
+	// are kept as deleted.
+	bad := make(map[*cell]bool)
+	drop := make(map[*cell]bool)
+	for _, c := range cells {
+		if c.Offset < 0 || c.Allocated < 0 || c.Used < 0 || c.Used > c.Allocated || c.PageIndex < 0 {
+			problem(c, c.PageIndex, ErrFlatFile.Errorf("invalid cell geometry: %w", ErrCorrupted))
+			if live(c) {
+				bad[c] = false
+			} else {
+				drop[c] = true
+			}
+			continue
+		}
+		size, ok := sizes[c.PageIndex]
+		if !ok {
+			if live(c) {
+				problem(c, c.PageIndex, ErrFlatFile.Errorf("page file missing: %w", ErrCorrupted))
+				bad[c] = false
+			} else {
+				drop[c] = true
+			}
+			continue
+		}
+		if !live(c) {
+			continue
+		}
+		if c.Offset+c.Used > size {
+			problem(c, c.PageIndex, ErrFlatFile.Errorf(
+				"blob ends at %d past page end %d: %w", c.Offset+c.Used, size, ErrCorrupted))
+			bad[c] = false
+			continue
+		}
+		if err := checkBlob(base, c, options); err != nil {
+			problem(c, c.PageIndex, err)
+			bad[c] = true
+		}
+	}
+	// Find overlapping cells. Of two overlapping cells a deleted one or the
+	// older one loses.
+	var last *cell
+	for _, c := range cells {
+		if _, isbad := bad[c]; isbad || drop[c] || c.Allocated == 0 {
+			continue
+		}
+		if last == nil || last.PageIndex != c.PageIndex || c.Offset >= last.BlobEndPos() {
+			last = c
+			continue
+		}
+		loser, winner := c, last
+		if live(c) && (!live(last) || c.CellID > last.CellID) {
+			loser, winner = last, c
+		}
+		problem(loser, loser.PageIndex, ErrFlatFile.Errorf(
+			"overlaps cell %d: %w", winner.CellID, ErrCorrupted))
+		if live(loser) {
+			bad[loser] = false
+		} else {
+			drop[loser] = true
+		}
+		if loser == last {
+			last = c
+		}
+	}
+	// Find orphan pages.
+	used := make(map[int64]bool)
+	for _, c := range cells {
+		if _, isbad := bad[c]; !isbad && !drop[c] {
+			used[c.PageIndex] = true
+		}
+	}
+	orphans := []int64{}
+	for _, pageidx := range pages {
+		if used[pageidx] {
+			continue
+		}
+		// A page may be used by cells of skipped records, keep it.
+		if skipped > 0 {
+			problem(nil, pageidx, ErrFlatFile.Errorf(
+				"page file not used by any cell read, kept as header records were skipped"))
+			continue
+		}
+		problem(nil, pageidx, ErrFlatFile.Errorf("page file not used by any cell"))
+		orphans = append(orphans, pageidx)
+	}
+	report.Keys = len(keys)
+	for c := range bad {
+		if keys[c.key] == c {
+			report.Keys--
+		}
+	}
+	if !repair || report.OK() {
+		return report, nil
+	}
+	// Repair.
+	qdir := filepath.Join(filename, QuarantineDir)
+	if err = os.MkdirAll(qdir, os.ModePerm); err != nil {
+		return report, ErrFlatFile.Errorf("quarantine dir create error: %w", err)
+	}
+	for c, keep := range bad {
+		if err = quarantineCell(base, qdir, c); err != nil {
+			return report, err
+		}
+		report.Quarantined++
+		if !keep {
+			h.cells.Destroy(c)
+			continue
+		}
+		c.key = ""
+		c.clearSum()
+		c.CellState = StateDeleted
+	}
+	for c := range drop {
+		h.cells.Destroy(c)
+	}
+	for _, c := range h.cells.cells {
+		if c.CellState == StateReclaimed {
+			h.cells.Destroy(c)
+		}
+	}
+	for _, pageidx := range orphans {
+		fn := fmt.Sprintf("%s.%.4d.%s", base, pageidx, StreamExt)
+		if err = os.Rename(fn, filepath.Join(qdir, filepath.Base(fn))); err != nil {
+			return report, ErrFlatFile.Errorf("page quarantine error: %w", err)
+		}
+		report.Quarantined++
+	}
+	if err = h.rewrite(); err != nil {
+		return report, err
+	}
+	report.Repaired = true
+	return report, nil
+}
+
+// checkBlob reads blob of used cell c from its page file of a FlatFile with
+// base filename base and verifies its checksum.
+func checkBlob(base string, c *cell, options *Options) error {
+	data, err := readCellData(base, c)
+	if err != nil {
+		return ErrFlatFile.Errorf("blob read error: %w", err)
+	}
+	blob := data
+	if options.StreamRecords {
+		rec, err := decodeBlobRecord(data, true)
+		if errors.Is(err, errInvalidBlobRecord) {
+			return ErrFlatFile.Errorf("%v: %w", err, ErrCorrupted)
+		}
+		if err != nil {
+			return err
+		}
+		if string(rec.key) != c.key {
+			return ErrFlatFile.Errorf("stream record key mismatch: %w", ErrCorrupted)
+		}
+		blob = rec.blob
+	}
+	return c.verify(blob)
+}
+
+// readCellData reads c.Used bytes of cell c from its page file of a FlatFile
+// with base filename base. If page file is shorter, returns data read.
+func readCellData(base string, c *cell) ([]byte, error) {
+	file, err := os.Open(fmt.Sprintf("%s.%.4d.%s", base, c.PageIndex, StreamExt))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data := make([]byte, c.Used)
+	n, err := file.ReadAt(data, c.Offset)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return data[:n], err
+}
+
+// quarantineCell writes readable data of cell c to a file in quarantine dir
+// qdir and appends a description of the cell to the quarantine log.
+func quarantineCell(base, qdir string, c *cell) error {
+	data := []byte{}
+	if c.Offset >= 0 && c.Used >= 0 {
+		data, _ = readCellData(base, c)
+	}
+	fn := filepath.Join(qdir, fmt.Sprintf("%d.blob", c.CellID))
+	if err := ioutil.WriteFile(fn, data, os.ModePerm); err != nil {
+		return ErrFlatFile.Errorf("cell quarantine error: %w", err)
+	}
+	log, err := os.OpenFile(filepath.Join(qdir, quarantineLog),
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return ErrFlatFile.Errorf("quarantine log open error: %w", err)
+	}
+	defer log.Close()
+	if _, err = fmt.Fprintf(log, "%d\t%d\t%d\t%d\t%q\n",
+		c.CellID, c.PageIndex, c.Offset, c.Used, c.key); err != nil {
+		return ErrFlatFile.Errorf("quarantine log write error: %w", err)
+	}
+	return nil
+}
+
+// salvage reads cells from header or checkpoint file data like header.read
+// but skips damaged records instead of stopping at the first one. Reading
+// resumes past the damaged record if its length leads to a valid record,
+// otherwise at the next offset that holds one. Returns the offset of the
+// incomplete last record or -1, the format version and the offsets of
+// skipped records. Legacy headers are read with header.read.
+func (h *header) salvage(data []byte) (tornat int64, version int, damaged []int64, err error) {
+	if len(data) < len(hdr) {
+		return -1, 0, nil, ErrFlatFile.Errorf("signature read failed: %w", io.ErrUnexpectedEOF)
+	}
+	switch {
+	case bytes.Equal(data[:len(hdr)], hdr):
+	case bytes.Equal(data[:len(hdr)], hdrLegacy):
+		return -1, 0, nil, h.readLegacy(newFullReader(bytes.NewReader(data[len(hdr):])))
+	default:
+		return -1, 0, nil, ErrFlatFile.Errorf("invalid header: %w", ErrCorrupted)
+	}
+	version = 1
+	// next parses the record at off, returns its end or -1 if invalid. It
+	// works on data directly and rejects a frame by its size before
+	// computing its checksum so probing every offset stays cheap.
+	next := func(off int64) (int64, recordType, []byte) {
+		if int64(len(data))-off < recordFrameSize {
+			return -1, 0, nil
+		}
+		size := int64(binary.LittleEndian.Uint32(data[off:]))
+		end := off + 4 + size + 4
+		if size == 0 || size > maxRecordSize || end > int64(len(data)) {
+			return -1, 0, nil
+		}
+		frame := data[off+4 : off+4+size]
+		if binary.LittleEndian.Uint32(data[end-4:]) != crc32.ChecksumIEEE(frame) {
+			return -1, 0, nil
+		}
+		typ, payload := recordType(frame[0]), frame[1:]
+		switch typ {
+		case recordVersion:
+			if off != int64(len(hdr)) || len(payload) != 2 {
+				return -1, 0, nil
+			}
+		case recordCell:
+			if err := (&cell{}).read(payload, version); err != nil {
+				return -1, 0, nil
+			}
+		default:
+			return -1, 0, nil
+		}
+		return end, typ, payload
+	}
+	off := int64(len(hdr))
+	for off < int64(len(data)) {
+		end, typ, payload := next(off)
+		if end < 0 {
+			// Find where reading resumes, past the damaged record if
+			// its length is valid, else at the next valid record.
+			resume := int64(-1)
+			if off+4 <= int64(len(data)) {
+				skip := off + 4 + int64(binary.LittleEndian.Uint32(data[off:])) + 4
+				if skip > off && skip < int64(len(data)) {
+					if e, _, _ := next(skip); e >= 0 {
+						resume = skip
+					}
+				}
+			}
+			// Scan forward once for the next valid frame.
+			for at := off + 1; resume < 0 && at < int64(len(data)); at++ {
+				if e, _, _ := next(at); e >= 0 {
+					resume = at
+				}
+			}
+			if resume < 0 {
+				// Nothing valid follows, it is the last record.
+				return off, version, damaged, nil
+			}
+			damaged = append(damaged, off)
+			off = resume
+			continue
+		}
+		switch typ {
+		case recordVersion:
+			version = int(binary.LittleEndian.Uint16(payload))
+			if version > FormatVersion {
+				return -1, version, damaged, nil
+			}
+		case recordCell:
+			c := &cell{}
+			c.read(payload, version)
+			h.cells.Mask(c)
+		}
+		off = end
+	}
+	return -1, version, damaged, nil
+}
@@ -0,0 +1,269 @@
+package flatfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+
+	testdir := "test/check"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.MaxPageSize = 4096
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := ff.Put([]byte(fmt.Sprintf("key%d", i)), make([]byte, 500)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bad, _ := ff.header.Cell([]byte("key5"))
+	badpage := ff.stream.Page(bad).filename
+	badoffset := bad.Offset
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Check(testdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Keys != 20 {
+		t.Fatalf("check failed, want no problems and 20 keys, got:\n%s", report)
+	}
+
+	// Damage a blob and add an orphan page.
+	file, err := os.OpenFile(badpage, os.O_RDWR, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{0xFF}, badoffset+10)
+	file.Close()
+	orphan := filepath.Join(testdir, "check.0099."+StreamExt)
+	if err := ioutil.WriteFile(orphan, []byte("orphan"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if report, err = Check(testdir); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 2 || report.Keys != 19 {
+		t.Fatalf("check failed, want 2 problems and 19 keys, got:\n%s", report)
+	}
+	if report, err = Repair(testdir); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Repaired || report.Quarantined != 2 {
+		t.Fatalf("repair failed, got:\n%s", report)
+	}
+	for _, fn := range []string{"check.0099." + StreamExt, fmt.Sprintf("%d.blob", bad.CellID)} {
+		if exists, _ := FileExists(filepath.Join(testdir, QuarantineDir, fn)); !exists {
+			t.Fatalf("repair failed, '%s' not quarantined", fn)
+		}
+	}
+	if report, err = Check(testdir); err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("repair failed, problems remain:\n%s", report)
+	}
+
+	ff, err = Open(testdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	if ff.Len() != 19 {
+		t.Fatalf("repair failed, want 19 keys, got %d", ff.Len())
+	}
+	if _, err := ff.Get([]byte("key5")); err != ErrKeyNotFound {
+		t.Fatalf("repair failed, want ErrKeyNotFound, got %v", err)
+	}
+	if err := ff.Put([]byte("key5"), make([]byte, 500)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairDamagedRecord(t *testing.T) {
+
+	testdir := "test/repairrecord"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.MaxPageSize = 4096
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := ff.Put([]byte(fmt.Sprintf("key%d", i)), make([]byte, 500)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage a record in the middle of the header.
+	fn := filepath.Join(testdir, "repairrecord."+HeaderExt)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := bytes.Index(data, []byte("key12"))
+	if at < 0 {
+		t.Fatal("record not found")
+	}
+	data[at] ^= 0xFF
+	if err := ioutil.WriteFile(fn, data, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Repair(testdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Repaired || report.Keys != 19 || report.Quarantined != 0 {
+		t.Fatalf("repair failed, want 19 keys and nothing quarantined, got:\n%s", report)
+	}
+	ff, err = Open(testdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	for i := 0; i < 20; i++ {
+		_, err := ff.Get([]byte(fmt.Sprintf("key%d", i)))
+		if i == 12 {
+			if err == nil {
+				t.Fatal("damaged key survived repair")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("key%d lost: %v", i, err)
+		}
+	}
+}
+
+func TestCheckRelocateLeftover(t *testing.T) {
+
+	testdir := "test/checkrelocate"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.PersistentHeader = true
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := ff.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Relocate key2 but crash before the old cell is deleted.
+	old, _ := ff.header.Cell([]byte("key2"))
+	blob, err := ff.get([]byte("key2"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := ff.blobData([]byte("key2"), blob)
+	newcell := ff.header.Select(false, int64(len(data)))
+	newcell.key = old.key
+	newcell.Checksum = old.Checksum
+	newcell.Sum = old.Sum
+	page, err := ff.stream.GetCellPage(newcell, ff.options.MaxPageSize, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := page.Put(newcell, data, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.header.Update(newcell, true); err != nil {
+		t.Fatal(err)
+	}
+	ff.header.file.Close()
+	ff.stream.Close()
+	ff.unlock()
+
+	report, err := Check(testdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Keys != 5 {
+		t.Fatalf("check failed, want 1 problem and 5 keys, got:\n%s", report)
+	}
+	p := report.Problems[0]
+	if p.Cell != old.CellID || !errors.Is(p.Err, ErrDuplicateKey) || errors.Is(p.Err, ErrCorrupted) {
+		t.Fatalf("check failed, want leftover of cell %d, got %s", old.CellID, p)
+	}
+	if report, err = Repair(testdir); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Repaired || report.Quarantined != 0 {
+		t.Fatalf("repair failed, got:\n%s", report)
+	}
+	if report, err = Check(testdir); err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("repair failed, problems remain:\n%s", report)
+	}
+
+	ff, err = Open(testdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	if cell, _ := ff.header.Cell([]byte("key2")); cell.CellID != newcell.CellID {
+		t.Fatalf("repair failed, want cell %d, got %d", newcell.CellID, cell.CellID)
+	}
+	if blob, err := ff.Get([]byte("key2")); err != nil || string(blob) != "val2" {
+		t.Fatalf("repair failed, want 'val2', got '%s' (%v)", blob, err)
+	}
+}
+
+func TestSalvageGap(t *testing.T) {
+
+	h := newHeader("")
+	h.cells = newPot()
+	buf := bytes.NewBuffer(nil)
+	buf.Write(hdr)
+	version := make([]byte, 2)
+	binary.LittleEndian.PutUint16(version, FormatVersion)
+	if err := writeRecord(buf, recordVersion, version); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if i == 2 {
+			// Damaged region, probed at every offset.
+			buf.Write(make([]byte, 1<<20))
+		}
+		c := &cell{CellID: CellID(i + 1), Offset: int64(i * 8), Allocated: 8, Used: 8}
+		if err := c.write(buf, fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tornat, _, damaged, err := h.salvage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tornat >= 0 || len(damaged) != 1 || len(h.cells.cells) != 4 {
+		t.Fatalf("salvage failed, torn at %d, damaged %v, %d cells",
+			tornat, damaged, len(h.cells.cells))
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"sync"
+)
+
+// ChecksumAlgorithm identifies an algorithm used to checksum blobs. It is
+// stored with each checksum so that each session of a FlatFile can use a
+// different algorithm, see Options.Checksum, without invalidating existing
+// checksums.
+type ChecksumAlgorithm uint8
+
+const (
+	// ChecksumCRC32 is CRC-32 with the IEEE polynomial.
+	ChecksumCRC32 ChecksumAlgorithm = iota
+	// ChecksumCRC32C is CRC-32 with the Castagnoli polynomial. It is
+	// hardware accelerated on most platforms.
+	ChecksumCRC32C
+	// ChecksumCRC64 is CRC-64 with the ECMA polynomial.
+	ChecksumCRC64
+	// ChecksumSHA256 is the SHA-256 cryptographic digest.
+	ChecksumSHA256
+
+	// ChecksumCustom is the first algorithm ID available to algorithms
+	// registered with RegisterChecksum.
+	ChecksumCustom ChecksumAlgorithm = 128
+)
+
+var (
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+	crc64Table  = crc64.MakeTable(crc64.ECMA)
+)
+
+// checksumsMutex guards checksums.
+var checksumsMutex sync.RWMutex
+
+// checksums holds known checksum algorithms.
+var checksums = map[ChecksumAlgorithm]checksum{
+	ChecksumCRC32:  {"crc32", func() hash.Hash { return crc32.NewIEEE() }},
+	ChecksumCRC32C: {"crc32c", func() hash.Hash { return crc32.New(crc32cTable) }},
+	ChecksumCRC64:  {"crc64", func() hash.Hash { return crc64.New(crc64Table) }},
+	ChecksumSHA256: {"sha256", sha256.New},
+}
+
+// checksum is a registered checksum algorithm.
+type checksum struct {
+	name string
+	new  func() hash.Hash
+}
+
+// RegisterChecksum registers a checksum algorithm under id with a name and
+// a function that returns a new hash.Hash that computes it. id must be >=
+// ChecksumCustom and not already registered. Algorithms must be registered
+// before opening FlatFiles that use them and always under the same id.
+func RegisterChecksum(id ChecksumAlgorithm, name string, new func() hash.Hash) error {
+	if id < ChecksumCustom {
+		return ErrFlatFile.Errorf("checksum id %d is reserved", id)
+	}
+	if new == nil || new().Size() > maxSumSize {
+		return ErrFlatFile.Errorf("invalid checksum '%s'", name)
+	}
+
+	checksumsMutex.Lock()
+	defer checksumsMutex.Unlock()
+
+	if _, ok := checksums[id]; ok {
+		return ErrFlatFile.Errorf("checksum id %d already registered", id)
+	}
+	checksums[id] = checksum{name, new}
+	return nil
+}
+
+// maxSumSize is the maximum size of a checksum in bytes.
+const maxSumSize = 255
+
+// String implements fmt.Stringer.
+func (ca ChecksumAlgorithm) String() string {
+	checksumsMutex.RLock()
+	defer checksumsMutex.RUnlock()
+	if cs, ok := checksums[ca]; ok {
+		return cs.name
+	}
+	return "unknown"
+}
+
+// Sum returns the checksum of data or an error if algorithm is unknown.
+func (ca ChecksumAlgorithm) Sum(data []byte) ([]byte, error) {
+	checksumsMutex.RLock()
+	cs, ok := checksums[ca]
+	checksumsMutex.RUnlock()
+	if !ok {
+		return nil, ErrFlatFile.Errorf("unknown checksum algorithm %d", ca)
+	}
+	h := cs.new()
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+// setSum sets the checksum of cell c to checksum of blob computed with
+// algorithm ca.
+func (c *cell) setSum(ca ChecksumAlgorithm, blob []byte) (err error) {
+	c.Checksum = ca
+	c.Sum, err = ca.Sum(blob)
+	return
+}
+
+// clearSum clears the checksum of cell c.
+func (c *cell) clearSum() {
+	c.Checksum = 0
+	c.Sum = nil
+}
+
+// verify verifies blob against the checksum of cell c. Returns nil if c has
+// no checksum, ErrChecksumFailed if verification failed or an error if
+// checksum algorithm is unknown.
+func (c *cell) verify(blob []byte) error {
+	if c.Sum == nil {
+		return nil
+	}
+	sum, err := c.Checksum.Sum(blob)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, c.Sum) {
+		return ErrChecksumFailed
+	}
+	return nil
+}
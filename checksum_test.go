@@ -0,0 +1,76 @@
+package flatfile
+
+import (
+	"errors"
+	"hash"
+	"hash/fnv"
+	"os"
+	"testing"
+)
+
+func TestChecksums(t *testing.T) {
+
+	testdir := "test/checksums"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	fnv64a := func() hash.Hash { return fnv.New64a() }
+	if err := RegisterChecksum(ChecksumCRC64, "crc64", fnv64a); err == nil {
+		t.Fatal("register checksum failed, registered a reserved id")
+	}
+	if err := RegisterChecksum(ChecksumCustom, "fnv64a", fnv64a); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterChecksum(ChecksumCustom, "fnv64a", fnv64a); err == nil {
+		t.Fatal("register checksum failed, registered an id twice")
+	}
+
+	algorithms := map[ChecksumAlgorithm]int{
+		ChecksumCRC32:  4,
+		ChecksumCRC32C: 4,
+		ChecksumCRC64:  8,
+		ChecksumSHA256: 32,
+		ChecksumCustom: 8,
+	}
+	val := []byte("value")
+	for alg, size := range algorithms {
+		key := []byte(alg.String())
+		options := NewOptions()
+		options.Checksum = alg
+		ff, err := Open(testdir, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ff.Put(key, val); err != nil {
+			t.Fatal(err)
+		}
+		cell, _ := ff.header.Cell(key)
+		if cell.Checksum != alg || len(cell.Sum) != size {
+			t.Fatalf("%s failed, want %d byte sum, got %s %x", alg, size, cell.Checksum, cell.Sum)
+		}
+		if _, err := ff.Get(key); err != nil {
+			t.Fatal(err)
+		}
+		if err := ff.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Existing checksums keep their algorithms.
+	ff, err := Open(testdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	for alg := range algorithms {
+		key := []byte(alg.String())
+		if _, err := ff.Get(key); err != nil {
+			t.Fatalf("%s failed: %v", alg, err)
+		}
+		cell, _ := ff.header.Cell(key)
+		ff.stream.Page(cell).file.WriteAt([]byte("X"), cell.Offset)
+		if _, err := ff.Get(key); !errors.Is(err, ErrChecksumFailed) {
+			t.Fatalf("%s failed, want ErrChecksumFailed, got %v", alg, err)
+		}
+	}
+}
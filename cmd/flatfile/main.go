@@ -2,8 +2,119 @@
 // Use of this source code is governed by a MIT
 // license that can be found in the LICENSE file.
 
+// Command flatfile is a FlatFile maintenance utility.
+//
+// Usage:
+//
+//	flatfile migrate <dir> [<dir>...]
+//	flatfile rebuild <dir>
+//	flatfile fsck [-repair] <dir>
+//
+// migrate upgrades FlatFiles in specified base directories to the current
+// format version in place.
+//
+// rebuild rebuilds the header of a FlatFile created with StreamRecords from
+// its stream pages.
+//
+// fsck checks a FlatFile for consistency and prints a report. With -repair
+// it quarantines bad cells and rewrites a consistent header. Exits with
+// status 1 if problems were found and not repaired.
 package main
 
-func main() {
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vedranvuk/flatfile"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: flatfile <command> [arguments]
+
+Commands:
+  migrate <dir> [<dir>...]  upgrade FlatFiles to format version %d in place
+  rebuild <dir>             rebuild FlatFile header from stream records
+  fsck [-repair] <dir>      check FlatFile consistency, optionally repair
+`, flatfile.FormatVersion)
+}
+
+func migrate(args []string) error {
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	for _, dir := range args {
+		migrated, err := flatfile.Migrate(dir)
+		if err != nil {
+			return err
+		}
+		if migrated {
+			fmt.Printf("%s: migrated to format version %d\n", dir, flatfile.FormatVersion)
+		} else {
+			fmt.Printf("%s: up to date\n", dir)
+		}
+	}
+	return nil
+}
+
+func rebuild(args []string) error {
+	if len(args) != 1 {
+		usage()
+		os.Exit(2)
+	}
+	keys, err := flatfile.Rebuild(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: rebuilt header with %d keys\n", args[0], keys)
+	return nil
+}
 
+func fsck(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "quarantine bad cells and rewrite a consistent header")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	check := flatfile.Check
+	if *repair {
+		check = flatfile.Repair
+	}
+	report, err := check(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s\n", fs.Arg(0), report)
+	if !report.OK() && !report.Repaired {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch flag.Arg(0) {
+	case "migrate":
+		err = migrate(flag.Args()[1:])
+	case "rebuild":
+		err = rebuild(flag.Args()[1:])
+	case "fsck":
+		err = fsck(flag.Args()[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
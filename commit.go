@@ -0,0 +1,169 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"sync"
+	"time"
+)
+
+// committer runs group commit. Writers wait on the committer after they
+// release the FlatFile lock and are released once a commit that started
+// after they were queued completes.
+type committer struct {
+	// mutex guards waiters and stopped.
+	mutex sync.Mutex
+	// waiters holds channels of writers waiting for the next commit.
+	waiters []chan error
+	// stopped specifies if the committer was stopped.
+	stopped bool
+	// kick signals the first waiter of a batch.
+	kick chan struct{}
+	// full signals that a batch reached GroupCommitSize.
+	full chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startCommitter starts group commit.
+func (ff *FlatFile) startCommitter() {
+	ff.committer = &committer{
+		kick: make(chan struct{}, 1),
+		full: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go ff.runCommitter(ff.committer)
+}
+
+// stopCommitter stops group commit, if running, after committing waiting
+// writers and waits for it to finish.
+func (ff *FlatFile) stopCommitter() {
+	if ff.committer == nil {
+		return
+	}
+	ff.committer.mutex.Lock()
+	stopped := ff.committer.stopped
+	ff.committer.stopped = true
+	ff.committer.mutex.Unlock()
+	if stopped {
+		return
+	}
+	close(ff.committer.stop)
+	<-ff.committer.done
+}
+
+// runCommitter commits batches of waiting writers until c is stopped.
+func (ff *FlatFile) runCommitter(c *committer) {
+	defer close(c.done)
+	for {
+		select {
+		case <-c.stop:
+			c.release(ff.commit)
+			return
+		case <-c.kick:
+		}
+		timer := time.NewTimer(ff.options.GroupCommitWindow)
+		select {
+		case <-timer.C:
+		case <-c.full:
+		case <-c.stop:
+		}
+		timer.Stop()
+		c.release(ff.commit)
+	}
+}
+
+// wait queues a writer and returns a channel that receives the result of
+// the commit that makes its writes durable.
+func (c *committer) wait(size int) <-chan error {
+	ch := make(chan error, 1)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stopped {
+		ch <- ErrFlatFile.Errorf("group commit stopped")
+		return ch
+	}
+	c.waiters = append(c.waiters, ch)
+	signal := func(s chan struct{}) {
+		select {
+		case s <- struct{}{}:
+		default:
+		}
+	}
+	if len(c.waiters) == 1 {
+		signal(c.kick)
+	}
+	if size > 0 && len(c.waiters) >= size {
+		signal(c.full)
+	}
+	return ch
+}
+
+// release commits with commit and releases waiting writers with its result.
+func (c *committer) release(commit func() error) {
+	c.mutex.Lock()
+	waiters := c.waiters
+	c.waiters = nil
+	c.mutex.Unlock()
+	if len(waiters) == 0 {
+		return
+	}
+	err := commit()
+	for _, ch := range waiters {
+		ch <- err
+	}
+}
+
+// commit commits FlatFile writes to stable storage: journal first, then
+// pages, then the header records queued since last commit, then the
+// changelog. Journal is reset if it grew past journalResetSize as the header
+// is durable afterwards. The mirror, if synchronous, and replicators are
+// synced next, then watchers are notified of the committed writes.
+func (ff *FlatFile) commit() error {
+
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	if ff.journal != nil {
+		if err := ff.journal.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := ff.stream.Sync(); err != nil {
+		return err
+	}
+	if err := ff.header.Flush(); err != nil {
+		return err
+	}
+	if err := ff.header.Sync(); err != nil {
+		return err
+	}
+	ff.header.Committed()
+	if ff.changelog != nil {
+		if err := ff.changelog.Sync(); err != nil {
+			return err
+		}
+	}
+	if ff.journal != nil && ff.journal.size > journalResetSize {
+		if err := ff.journal.Reset(); err != nil {
+			return err
+		}
+	}
+	// Asynchronous mirror is behind and syncs as it applies queued writes.
+	if ff.mirror != nil && ff.mirrorQueue == nil {
+		if err := ff.mirror.commit(); err != nil {
+			return ErrFlatFile.Errorf("mirror error: %w", err)
+		}
+	}
+	if err := ff.syncReplicators(); err != nil {
+		return err
+	}
+	ff.notify(ff.unwatched)
+	ff.unwatched = nil
+	return nil
+}
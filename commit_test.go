@@ -0,0 +1,169 @@
+package flatfile
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroupCommit(t *testing.T) {
+
+	testdir := "test/groupcommit"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.GroupCommit = true
+	options.GroupCommitSize = 8
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, puts = 8, 25
+	wg := sync.WaitGroup{}
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < puts; i++ {
+				key := []byte(fmt.Sprintf("key%d.%d", w, i))
+				if err := ff.Put(key, bytes.Repeat(key, 10)); err != nil {
+					errs <- err
+					return
+				}
+				if i%5 == 0 {
+					if err := ff.Delete(key); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// Crash after all writes returned, without flushing the header.
+	ff.stopCommitter()
+	ff.header.file.Close()
+	ff.stream.Close()
+	ff.unlock()
+
+	ff, err = Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	if want := writers * (puts - puts/5); ff.Len() != want {
+		t.Fatalf("group commit failed, want %d keys, got %d", want, ff.Len())
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < puts; i++ {
+			key := []byte(fmt.Sprintf("key%d.%d", w, i))
+			blob, err := ff.Get(key)
+			if i%5 == 0 {
+				if err != ErrKeyNotFound {
+					t.Fatalf("group commit failed, deleted key '%s' found", key)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(blob, bytes.Repeat(key, 10)) {
+				t.Fatalf("group commit failed, key '%s' value mismatch", key)
+			}
+		}
+	}
+}
+
+// copyDir copies regular files of directory src to a new directory dst.
+func copyDir(t *testing.T, src, dst string) {
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	fis, err := ioutil.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(src, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dst, fi.Name()), data, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGroupCommitReuse(t *testing.T) {
+
+	testdir := "test/groupcommitreuse"
+	crashdir := "test/crash/groupcommitreuse"
+	os.RemoveAll(testdir)
+	os.RemoveAll(crashdir)
+	defer os.RemoveAll(testdir)
+	defer os.RemoveAll("test/crash")
+
+	options := NewOptions()
+	options.GroupCommit = true
+	options.GroupCommitWindow = time.Hour
+	options.MaxPageSize = 1 << 16
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	none := PutOpts{Durability: DurabilityNone}
+	if err := ff.PutWith([]byte("k1"), []byte("value1"), none); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.DeleteWith([]byte("k1"), none); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.PutWith([]byte("k2"), []byte("value2"), none); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := ff.header.Cell([]byte("k2")); c.CellState == StateReused {
+		t.Fatal("put reused a cell deleted since last commit")
+	}
+
+	// Crash before the delete is committed.
+	copyDir(t, testdir, crashdir)
+	crash, err := Open(crashdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer crash.Close()
+	if blob, err := crash.Get([]byte("k1")); err != nil || string(blob) != "value1" {
+		t.Fatalf("want k1 after crash, got '%s' (%v)", blob, err)
+	}
+
+	// Deleted cell is reused once committed.
+	if err := ff.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.PutWith([]byte("k3"), []byte("value3"), none); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := ff.header.Cell([]byte("k3")); c.CellState != StateReused {
+		t.Fatal("put did not reuse a committed deleted cell")
+	}
+}
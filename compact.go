@@ -0,0 +1,231 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"time"
+)
+
+// CompactProgress describes progress of background compaction of a page.
+type CompactProgress struct {
+	// Page is the index of the page being compacted.
+	Page int64
+	// Moved is the number of cells moved from the page so far.
+	Moved int
+	// Remaining is the number of cells left to move from the page.
+	Remaining int
+	// Bytes is the number of bytes moved from the page so far.
+	Bytes int64
+	// Done specifies if the page has been emptied and removed.
+	Done bool
+	// Err holds an error that stopped compaction of the page, if any.
+	Err error
+}
+
+// compactor runs background compaction.
+type compactor struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// SetCompactProgress sets f as the function that receives progress of
+// background compaction. f is called without FlatFile locks held.
+func (ff *FlatFile) SetCompactProgress(f func(CompactProgress)) {
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+	ff.onCompact = f
+}
+
+// startCompactor starts background compaction.
+func (ff *FlatFile) startCompactor() {
+	ff.compactor = &compactor{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go ff.runCompactor(ff.compactor)
+}
+
+// stopCompactor stops background compaction, if running, and waits for it
+// to finish.
+func (ff *FlatFile) stopCompactor() {
+	if ff.compactor == nil {
+		return
+	}
+	close(ff.compactor.stop)
+	<-ff.compactor.done
+	ff.compactor = nil
+}
+
+// runCompactor compacts pages each CompactInterval until c is stopped.
+func (ff *FlatFile) runCompactor(c *compactor) {
+	defer close(c.done)
+	ticker := time.NewTicker(ff.options.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			ff.compactPages(c.stop)
+		}
+	}
+}
+
+// compactPages compacts all pages whose used space ratio is below
+// CompactRatio until done or stop is closed.
+func (ff *FlatFile) compactPages(stop <-chan struct{}) {
+	for _, pageidx := range ff.sparsePages() {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		ff.compactPage(pageidx, stop)
+	}
+}
+
+// sparsePages returns indexes of pages whose used space ratio is below
+// CompactRatio. Last page is never returned.
+func (ff *FlatFile) sparsePages() (result []int64) {
+
+	ff.mutex.RLock()
+	defer ff.mutex.RUnlock()
+
+	if ff.options.MaxPageSize <= 0 {
+		return
+	}
+	for i := 0; i < len(ff.stream.pages)-1; i++ {
+		if ff.stream.pages[i] == nil {
+			continue
+		}
+		used := ff.header.Used(int64(i))
+		if float64(used)/float64(ff.options.MaxPageSize) < ff.options.CompactRatio {
+			result = append(result, int64(i))
+		}
+	}
+	return
+}
+
+// compactPage moves used cells from page with index pageidx to the last
+// page in batches of CompactBatch cells, then removes the page. The page is
+// fenced while compacted so its free space is not reused.
+func (ff *FlatFile) compactPage(pageidx int64, stop <-chan struct{}) {
+
+	ff.mutex.Lock()
+	ff.header.Fence(pageidx)
+	keys := ff.header.PageKeys(pageidx)
+	ff.mutex.Unlock()
+	defer func() {
+		ff.mutex.Lock()
+		ff.header.Unfence(pageidx)
+		ff.mutex.Unlock()
+	}()
+
+	batch := ff.options.CompactBatch
+	if batch <= 0 {
+		batch = 1
+	}
+	progress := CompactProgress{Page: pageidx, Remaining: len(keys)}
+	for len(keys) > 0 {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		n := batch
+		if n > len(keys) {
+			n = len(keys)
+		}
+		ff.mutex.Lock()
+		count, moved, err := ff.relocateKeys(pageidx, keys[:n])
+		ff.mutex.Unlock()
+		keys = keys[n:]
+		progress.Moved += count
+		progress.Remaining = len(keys)
+		progress.Bytes += moved
+		if err != nil {
+			progress.Err = err
+			ff.compactProgress(progress)
+			return
+		}
+		ff.compactProgress(progress)
+		// Throttle.
+		if ff.options.CompactRate > 0 && moved > 0 {
+			d := time.Duration(moved * int64(time.Second) / ff.options.CompactRate)
+			select {
+			case <-stop:
+				return
+			case <-time.After(d):
+			}
+		}
+	}
+	ff.mutex.Lock()
+	err := ff.reclaim(pageidx)
+	ff.mutex.Unlock()
+	progress.Done = err == nil
+	progress.Err = err
+	ff.compactProgress(progress)
+}
+
+// relocateKeys relocates cells under keys that are still on page with index
+// pageidx and returns the number of cells and bytes moved.
+func (ff *FlatFile) relocateKeys(pageidx int64, keys [][]byte) (count int, moved int64, err error) {
+	for _, key := range keys {
+		cell, ok := ff.header.Cell(key)
+		if !ok || cell.PageIndex != pageidx {
+			continue
+		}
+		if err = ff.relocate(cell); err != nil {
+			return
+		}
+		count++
+		moved += cell.Used
+	}
+	return
+}
+
+// relocate moves blob of cell c to a new cell at the end of the stream. New
+// cell is written to header before c is marked as deleted.
+func (ff *FlatFile) relocate(c *cell) (err error) {
+	blob, err := ff.get([]byte(c.key), false)
+	if err != nil {
+		return ErrFlatFile.Errorf("relocate error: %w", err)
+	}
+	data := ff.blobData([]byte(c.key), blob)
+	newcell := ff.header.Select(false, int64(len(data)))
+	newcell.key = c.key
+	newcell.Checksum = c.Checksum
+	newcell.Sum = c.Sum
+	newpage, err := ff.stream.GetCellPage(
+		newcell,
+		ff.options.MaxPageSize,
+		ff.options.PreallocatePages,
+		ff.options.SyncWrites)
+	if err != nil {
+		ff.header.Destroy(newcell)
+		return ErrFlatFile.Errorf("relocate error: %w", err)
+	}
+	if err = newpage.Put(newcell, data, false); err != nil {
+		ff.header.Destroy(newcell)
+		return ErrFlatFile.Errorf("relocate error: %w", err)
+	}
+	if err = ff.header.Update(newcell, ff.options.PersistentHeader); err != nil {
+		ff.header.Destroy(newcell)
+		return ErrFlatFile.Errorf("relocate error: %w", err)
+	}
+	err = ff.discard(c)
+	ff.header.Use(newcell)
+	return
+}
+
+// compactProgress reports compaction progress p.
+func (ff *FlatFile) compactProgress(p CompactProgress) {
+	ff.mutex.RLock()
+	f := ff.onCompact
+	ff.mutex.RUnlock()
+	if f != nil {
+		f(p)
+	}
+}
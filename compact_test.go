@@ -0,0 +1,204 @@
+package flatfile
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCompactPages(t *testing.T) {
+
+	testdir := "test/compactpages"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.MaxPageSize = 1024
+	options.CompactBatch = 1
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make(map[string][]byte)
+	for i := 0; i < 21; i++ {
+		key := fmt.Sprintf("key%.2d", i)
+		val := []byte(fmt.Sprintf("%-100d", i))
+		data[key] = val
+		if err := ff.Put([]byte(key), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ff.stream.pages) != 3 {
+		t.Fatalf("compact failed, want 3 pages, got %d", len(ff.stream.pages))
+	}
+	for i := 0; i < 8; i++ {
+		key := fmt.Sprintf("key%.2d", i)
+		delete(data, key)
+		if err := ff.Delete([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var last CompactProgress
+	ff.SetCompactProgress(func(p CompactProgress) {
+		last = p
+	})
+	ff.compactPages(nil)
+	if last.Page != 0 || !last.Done || last.Moved != 2 || last.Err != nil {
+		t.Fatalf("compact failed, got progress %#v", last)
+	}
+	if ff.stream.pages[0] != nil || ff.stream.pages[1] == nil {
+		t.Fatal("compact failed, wrong pages removed")
+	}
+
+	if err := ff.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	for key, val := range data {
+		blob, err := ff.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(blob) != string(val) {
+			t.Fatalf("compact failed, want '%s', got '%s'", string(val), string(blob))
+		}
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sparseFlatFile opens a FlatFile in testdir with 3 pages of which the first
+// holds 2 used and 8 deleted cells.
+func sparseFlatFile(t *testing.T, testdir string, options *Options) *FlatFile {
+	options.MaxPageSize = 1024
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 21; i++ {
+		key := fmt.Sprintf("key%.2d", i)
+		if err := ff.Put([]byte(key), []byte(fmt.Sprintf("%-100d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		if err := ff.Delete([]byte(fmt.Sprintf("key%.2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ff
+}
+
+func TestCompactFence(t *testing.T) {
+
+	testdir := "test/compactfence"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.CompactBatch = 1
+	ff := sparseFlatFile(t, testdir, options)
+	defer ff.Close()
+
+	// Puts must not reuse space of a page being compacted.
+	ff.header.Fence(0)
+	if err := ff.Put([]byte("new"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := ff.header.Cell([]byte("new")); c.PageIndex == 0 {
+		t.Fatal("put reused space on fenced page")
+	}
+	// Keys no longer on the page are not counted as moved.
+	count, _, err := ff.relocateKeys(0, [][]byte{[]byte("key08"), []byte("key00"), []byte("new")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("want 1 cell moved, got %d", count)
+	}
+	ff.header.Unfence(0)
+
+	var last CompactProgress
+	ff.SetCompactProgress(func(p CompactProgress) {
+		last = p
+	})
+	ff.compactPages(nil)
+	if last.Page != 0 || !last.Done || last.Moved != 1 || last.Err != nil {
+		t.Fatalf("compact failed, got progress %#v", last)
+	}
+}
+
+func TestCompactBackground(t *testing.T) {
+
+	testdir := "test/compactbackground"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.CompactBatch = 1
+	options.CompactInterval = 10 * time.Millisecond
+	options.CompactRate = 1000
+	ff := sparseFlatFile(t, testdir, options)
+	defer ff.Close()
+
+	done := make(chan CompactProgress, 1)
+	var progress []CompactProgress
+	ff.SetCompactProgress(func(p CompactProgress) {
+		progress = append(progress, p)
+		if p.Done || p.Err != nil {
+			done <- p
+		}
+	})
+	start := time.Now()
+	select {
+	case p := <-done:
+		if p.Page != 0 || !p.Done || p.Moved != 2 || p.Err != nil {
+			t.Fatalf("compact failed, got progress %#v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("background compaction timed out")
+	}
+	// Two 100 byte cells at 1000 bytes per second take at least 200ms.
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("compaction not throttled, took %v", d)
+	}
+	if len(progress) != 3 || progress[0].Moved != 1 || progress[0].Remaining != 1 {
+		t.Fatalf("unexpected progress %#v", progress)
+	}
+	ff.mutex.RLock()
+	removed := ff.stream.pages[0] == nil
+	ff.mutex.RUnlock()
+	if !removed {
+		t.Fatal("compact failed, page not removed")
+	}
+}
+
+func TestCompactClear(t *testing.T) {
+
+	testdir := "test/compactclear"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.CompactInterval = time.Millisecond
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	running := ff.compactor
+	if err := ff.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-running.done:
+	default:
+		t.Fatal("compactor running during clear")
+	}
+	if ff.compactor == nil {
+		t.Fatal("compactor not restarted after clear")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+// Durability defines when a write operation returns relative to its writes
+// reaching the disk.
+type Durability uint8
+
+const (
+	// DurabilityDefault returns as configured by options: once writes are
+	// synced if GroupCommit is enabled, otherwise once they are written
+	// with SyncWrites and PersistentHeader applied.
+	DurabilityDefault Durability = iota
+	// DurabilityNone returns as soon as the operation is applied. Header
+	// records may still be in memory. If GroupCommit is enabled, writes
+	// are synced with the next batch without waiting for it.
+	DurabilityNone
+	// DurabilityFlushed returns once the blob and its header records are
+	// written to files. Writes survive a process crash but not a power
+	// loss, unless SyncWrites is enabled.
+	DurabilityFlushed
+	// DurabilitySynced returns once the blob, its header records and the
+	// journal are synced to stable storage, including the mirror. An
+	// asynchronous mirror is drained and synced first; an error wrapping
+	// ErrMirrorDiverged is returned if it has diverged. Writes survive a
+	// power loss.
+	DurabilitySynced
+)
+
+// PutOpts holds options of a single Put, Modify or Delete operation.
+type PutOpts struct {
+	// Durability specifies when the operation returns.
+	Durability Durability
+}
+
+// settle waits for writes of a successful operation to reach durability d
+// and sets err to an error that prevented it, if any. It must be called
+// without the FlatFile lock held.
+func (ff *FlatFile) settle(d Durability, err *error) {
+	if *err != nil {
+		return
+	}
+	switch d {
+	case DurabilityNone:
+		if ff.committer != nil {
+			ff.committer.wait(ff.options.GroupCommitSize)
+		}
+	case DurabilityFlushed:
+		*err = ff.flush()
+	case DurabilitySynced:
+		if ff.committer != nil {
+			*err = <-ff.committer.wait(ff.options.GroupCommitSize)
+		} else {
+			*err = ff.commit()
+		}
+		if *err == nil {
+			*err = ff.syncMirrorQueue()
+		}
+	default:
+		if ff.committer != nil {
+			*err = <-ff.committer.wait(ff.options.GroupCommitSize)
+		}
+	}
+}
+
+// syncMirrorQueue waits until operations queued for an asynchronous mirror
+// are applied, then syncs the mirror. Returns an error wrapping
+// ErrMirrorDiverged if the mirror has diverged. It must be called without
+// the FlatFile lock held.
+func (ff *FlatFile) syncMirrorQueue() error {
+
+	ff.mutex.RLock()
+	q, mirror := ff.mirrorQueue, ff.mirror
+	ff.mutex.RUnlock()
+
+	if q == nil {
+		return nil
+	}
+	q.drain()
+	q.mutex.Lock()
+	diverged := q.stats.Diverged
+	q.mutex.Unlock()
+	if diverged {
+		return ErrFlatFile.Errorf("mirror error: %w", ErrMirrorDiverged)
+	}
+	if err := mirror.commit(); err != nil {
+		return ErrFlatFile.Errorf("mirror error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package flatfile
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestDurability(t *testing.T) {
+
+	testdir := "test/durability"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.PersistentHeader = false
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	puts := []struct {
+		key        string
+		durability Durability
+		survives   bool
+	}{
+		{"flushed", DurabilityFlushed, true},
+		{"synced", DurabilitySynced, true},
+		{"none", DurabilityNone, false},
+	}
+	for _, put := range puts {
+		if err := ff.PutWith([]byte(put.key), []byte(put.key), PutOpts{put.durability}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Crash without flushing the header.
+	ff.header.file.Close()
+	ff.stream.Close()
+	ff.unlock()
+
+	ff, err = Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	for _, put := range puts {
+		blob, err := ff.Get([]byte(put.key))
+		if !put.survives {
+			if err != ErrKeyNotFound {
+				t.Fatalf("durability failed, key '%s' survived", put.key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(blob) != put.key {
+			t.Fatalf("durability failed, key '%s' value mismatch", put.key)
+		}
+	}
+}
+
+func TestDurabilityMirror(t *testing.T) {
+
+	testdir := "test/durabilitymirror"
+	mirrordir := "test/durabilitymirrormirror"
+	os.RemoveAll(testdir)
+	os.RemoveAll(mirrordir)
+	defer os.RemoveAll(testdir)
+	defer os.RemoveAll(mirrordir)
+
+	options := NewOptions()
+	options.PersistentHeader = false
+	options.MirrorDir = mirrordir
+	options.MirrorAsync = true
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+
+	// Synced write is on the mirror once it returns.
+	if err := ff.PutWith([]byte("synced"), []byte("synced"), PutOpts{DurabilitySynced}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := ff.MirrorStats(); stats.Queued != 0 || stats.Applied != 1 {
+		t.Fatalf("mirror not drained: %+v", stats)
+	}
+	if blob, err := ff.mirror.Get([]byte("synced")); err != nil || string(blob) != "synced" {
+		t.Fatalf("mirror want 'synced', got '%s' (%v)", blob, err)
+	}
+	if len(ff.mirror.header.dirty) != 0 {
+		t.Fatal("mirror header not synced")
+	}
+
+	// Synced write fails on a diverged mirror.
+	ff.mirrorQueue.mutex.Lock()
+	ff.mirrorQueue.diverge()
+	ff.mirrorQueue.mutex.Unlock()
+	err = ff.PutWith([]byte("diverged"), []byte("diverged"), PutOpts{DurabilitySynced})
+	if !errors.Is(err, ErrMirrorDiverged) {
+		t.Fatalf("want ErrMirrorDiverged, got %v", err)
+	}
+}
@@ -49,4 +49,39 @@ var (
 
 	// ErrChecksumFailed is returned if a crc failed after a cell Get.
 	ErrChecksumFailed = FlatFileError{errors.New("blob checksum failed")}
+
+	// ErrNotSupported is returned when an operation is not supported by the
+	// platform or the filesystem.
+	ErrNotSupported = FlatFileError{errors.New("operation not supported")}
+
+	// ErrNoSpace is returned when there is not enough disk space to
+	// preallocate a page.
+	ErrNoSpace = FlatFileError{errors.New("not enough disk space")}
+
+	// ErrCorrupted is returned when invalid data is found in a file.
+	ErrCorrupted = FlatFileError{errors.New("corrupted data")}
+
+	// ErrFormatVersion is returned when a file is of an unsupported format
+	// version.
+	ErrFormatVersion = FlatFileError{errors.New("unsupported format version")}
+
+	// ErrLocked is returned when a FlatFile is locked by another process or
+	// FlatFile instance.
+	ErrLocked = FlatFileError{errors.New("locked by another process")}
+
+	// ErrReadOnly is returned when a modifying method has been called on a
+	// FlatFile opened as read-only.
+	ErrReadOnly = FlatFileError{errors.New("read-only file")}
+
+	// ErrNoMirror is returned when a mirror operation has been called on a
+	// FlatFile without a mirror.
+	ErrNoMirror = FlatFileError{errors.New("no mirror")}
+
+	// ErrMirrorDiverged is returned by Promote when the mirror is marked as
+	// diverged from its primary.
+	ErrMirrorDiverged = FlatFileError{errors.New("mirror diverged")}
+
+	// ErrChangesTrimmed is returned by ChangesSince when changes after the
+	// requested sequence number were trimmed from the changelog.
+	ErrChangesTrimmed = FlatFileError{errors.New("changes trimmed")}
 )
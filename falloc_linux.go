@@ -0,0 +1,40 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package flatfile
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	// fallocKeepSize is FALLOC_FL_KEEP_SIZE.
+	fallocKeepSize = 0x01
+	// fallocPunchHole is FALLOC_FL_PUNCH_HOLE.
+	fallocPunchHole = 0x02
+)
+
+// punchHole deallocates size bytes of file space at offset without changing
+// file size. Returns ErrNotSupported if filesystem does not support it.
+func punchHole(file *os.File, offset, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), fallocKeepSize|fallocPunchHole, offset, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return ErrNotSupported
+	}
+	return err
+}
+
+// reserve allocates size bytes of file space at offset, extending the file
+// if needed. Returns ErrNotSupported if filesystem does not support it.
+func reserve(file *os.File, offset, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, offset, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return ErrNotSupported
+	}
+	return err
+}
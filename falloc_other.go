@@ -0,0 +1,22 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package flatfile
+
+import (
+	"os"
+)
+
+// punchHole is not supported on this platform and returns ErrNotSupported.
+func punchHole(file *os.File, offset, size int64) error {
+	return ErrNotSupported
+}
+
+// reserve is not supported on this platform and returns ErrNotSupported.
+func reserve(file *os.File, offset, size int64) error {
+	return ErrNotSupported
+}
@@ -26,6 +26,10 @@
 // entries each time it is (re)loaded, but can be set to hold the complete
 // history of changes.
 //
+// Header can be checkpointed after a number of appended records. Checkpoint
+// is a snapshot of all cells in a separate .checkpoint file after which the
+// header is truncated. Checkpoint is loaded before the header.
+//
 // Stream is always immediately persisted. Stream size can be limited and split
 // across files as pages. In that case Put data size must be less than the page
 // size limit. Pages can be preallocated. A new blob that doesn't fit in the
@@ -37,12 +41,14 @@
 // during a session where Header is set to persist on session end and there were
 // modifications to the file.
 //
-// Intents can be used when writing reused blobs. Intents backup cell and blob
-// before writing into blob. After a mid-write power failure, when FlatFile is
-// opened it looks for Intent files and if any found, restores cells and blobs,
-// them removes the intents.
-// In case a new cell is being added and failure occurs mid-write, write will
-// simply fail and any data partially written will be trimmed on next Open.
+// A write-ahead journal can be used to make Put, Modify and Delete atomic and
+// recoverable. Each operation is recorded in the journal with its new and old
+// value before it changes Stream or Header. When FlatFile is opened, journaled
+// operations are replayed, completing those interrupted by a crash or rolling
+// them back if they can not be completed, and operations whose cells were not
+// yet persisted to Header are redone. See journal.go for guarantees.
+// Without the journal, in case a failure occurs mid-write, write will simply
+// fail and any data partially written will be trimmed on next Open.
 //
 // Cells, when newly created, allocate space in the Stream of same size as the
 // Put operation data that initiated it. As both Header and Stream are written
@@ -55,22 +61,32 @@
 // cells a new one is created.
 //
 // FlatFile can be Compacted to trim unused space both from Header and Stream.
+// Stream pages can also be compacted in the background, incrementally, by
+// moving used blobs from sparsely used pages to the last page.
+//
+// Blobs can be scrubbed, periodically in the background or on demand, by
+// reading them back and verifying their checksums. Blobs that fail are
+// repaired from the mirror, if one is configured.
 package flatfile
 
 import (
 	"fmt"
-	"hash/crc32"
 	"os"
 	"path/filepath"
 	"sync"
 )
 
 const (
-	HeaderExt  = "header"
-	StreamExt  = "stream"
-	ConcatExt  = "concat"
-	OptionsExt = "options"
-	IntentsDir = ".intents"
+	HeaderExt     = "header"
+	StreamExt     = "stream"
+	ConcatExt     = "concat"
+	OptionsExt    = "options"
+	CheckpointExt = "checkpoint"
+	JournalExt    = "journal"
+	ChangelogExt  = "changelog"
+	LockExt       = "lock"
+	DivergedExt   = "diverged"
+	QuarantineDir = ".quarantine"
 )
 
 // FlatFile represents the actual flat file.
@@ -80,8 +96,43 @@ type FlatFile struct {
 	options  *Options
 	header   *header
 	stream   *stream
-	intents  *FlatFile
+	journal  *journal
 	mirror   *FlatFile
+
+	// compactor is the background compactor, if running.
+	compactor *compactor
+	// onCompact is the background compaction progress callback.
+	onCompact func(CompactProgress)
+	// scrubber is the background scrubber, if running.
+	scrubber *scrubber
+	// onScrub is the background scrub report callback.
+	onScrub func(ScrubResult)
+	// lockfile is the locked lock file.
+	lockfile *os.File
+	// committer is the group committer, if running.
+	committer *committer
+	// flusher is the background header flusher, if running.
+	flusher *flusher
+	// follower is the background header follower, if running.
+	follower *follower
+	// followed describes followed files if opened with OpenFollower.
+	followed *followInfo
+	// onFollow is the background follow error callback.
+	onFollow func(error)
+	// mirrorQueue is the asynchronous mirror queue, if running.
+	mirrorQueue *mirrorQueue
+	// replicators are replicators added with AddReplicator.
+	replicators []Replicator
+	// changelog is the changelog, if enabled.
+	changelog *changelog
+	// events is the sequence number of the last replicated event.
+	events uint64
+	// watchers are watch subscriptions.
+	watchers []*watcher
+	// unwatched holds events held for watchers until next group commit.
+	unwatched []Event
+	// seq is the last stream record sequence number.
+	seq uint64
 }
 
 // Open opens an existing or creates a new FlatFile in the
@@ -100,6 +151,9 @@ func Open(filename string, options *Options) (*FlatFile, error) {
 	if err != nil {
 		return nil, ErrFlatFile.Errorf("base dir '%s' stat error: %w", filename, err)
 	}
+	if !dirExists && options != nil && options.ReadOnly {
+		return nil, ErrFlatFile.Errorf("base dir '%s' does not exist", filename)
+	}
 	if !dirExists {
 		if err := os.MkdirAll(filename, os.ModePerm); err != nil {
 			return nil, ErrFlatFile.Errorf("can't create base dir '%s': %w", filename, err)
@@ -118,27 +172,54 @@ func Open(filename string, options *Options) (*FlatFile, error) {
 		ff.options = NewOptions()
 	}
 	ff.options.filename = fmt.Sprintf("%s.%s", filepath.Join(filename, bn), OptionsExt)
+	// Lock.
+	if err := ff.lock(); err != nil {
+		return nil, err
+	}
 	if err := ff.loadOptions(); err != nil {
+		ff.unlock()
+		return nil, err
+	}
+	if _, err := ff.options.Checksum.Sum(nil); err != nil && ff.options.CRC {
+		ff.unlock()
 		return nil, err
 	}
 	// Load file.
 	if err := ff.load(ff.options.CompactHeader); err != nil {
+		ff.unlock()
 		return nil, err
 	}
 	// Setup optional mirror.
-	if ff.options.MirrorDir != "" && !ff.options.utility {
-		mirroropt := NewOptions()
-		*mirroropt = *ff.options
-		mirroropt.utility = true
-		mirror, err := Open(ff.options.MirrorDir, mirroropt)
-		if err != nil {
-			return nil, ErrFlatFile.Errorf("mirror error: %w", err)
+	if ff.options.MirrorDir != "" && !ff.options.utility && !ff.options.ReadOnly {
+		if err := ff.openMirror(); err != nil {
+			ff.Close()
+			return nil, err
 		}
-		ff.mirror = mirror
 	}
 	return ff, nil
 }
 
+// lock locks the FlatFile against other processes, shared if ReadOnly,
+// exclusive otherwise. Followers are not locked.
+func (ff *FlatFile) lock() (err error) {
+	if ff.options.follower {
+		return nil
+	}
+	bn := filepath.Base(ff.filename)
+	fn := fmt.Sprintf("%s.%s", filepath.Join(ff.filename, bn), LockExt)
+	ff.lockfile, err = lockFile(fn, !ff.options.ReadOnly)
+	return
+}
+
+// unlock unlocks the FlatFile, if locked.
+func (ff *FlatFile) unlock() {
+	if ff.lockfile == nil {
+		return
+	}
+	ff.lockfile.Close()
+	ff.lockfile = nil
+}
+
 // loadOptions loads options, if they exist.
 func (ff *FlatFile) loadOptions() error {
 	exists, err := FileExists(ff.options.filename)
@@ -168,88 +249,154 @@ func (ff *FlatFile) saveOptions() (err error) {
 	return
 }
 
-// restoreFromIntents restores cells from intents.
-func (ff *FlatFile) restoreFromIntents() error {
-
-	ff.mutex.Lock()
-	defer ff.mutex.Unlock()
-
-	for _, intentkey := range ff.intents.Keys() {
-		blob, err := ff.intents.Get(intentkey)
-		if err != nil {
-			return ErrFlatFile.Errorf("intent restore get error: %w", err)
-		}
-		if err = ff.put(intentkey, blob); err != nil {
-			return ErrFlatFile.Errorf("intent restore put error: %w", err)
-		}
-	}
-	if err := ff.intents.Clear(); err != nil {
-		return ErrFlatFile.Errorf("intents clear error: %w", err)
-	}
-	return nil
-}
-
 // load loads the Header and Stream.
 func (ff *FlatFile) load(compactheader bool) (err error) {
 	// Open and load the header.
+	ff.header.policy = ff.options.Allocator
+	ff.header.interval = ff.options.CheckpointRecords
+	ff.stream.mode = ff.options.PreallocMode
+	ff.stream.chunk = ff.options.PreallocChunkSize
+	ff.header.readonly = ff.options.ReadOnly
+	ff.stream.readonly = ff.options.ReadOnly
 	maxpage, err := ff.header.Open(ff.options.CompactHeader, ff.options.SyncWrites)
 	if err != nil {
 		return ErrFlatFile.Errorf("header open error: %w", err)
 	}
 	// Open stream page files.
-	if ff.Len() > 0 {
+	if maxpage >= 0 {
 		if err = ff.stream.Open(maxpage+1, ff.options.SyncWrites); err != nil {
 			ff.header.Close()
 			return ErrFlatFile.Errorf("stream open error: %w", err)
 		}
 	}
-	// Setup optional intents.
-	if ff.options.UseIntents && !ff.options.utility {
-		ittfn := filepath.Join(ff.filename, IntentsDir)
-		if err := os.MkdirAll(ittfn, os.ModePerm); err != nil {
-			return ErrFlatFile.Errorf("make intents dir error: %w", err)
-		}
-		intentsopt := NewOptions()
-		*intentsopt = *ff.options
-		intentsopt.utility = true
-		intentsopt.PersistentHeader = true
-		intentsopt.CachedWrites = false
-		intentsopt.MaxCacheMemory = 0
-		intentsopt.ZeroPadDeleted = false
-		intents, err := Open(ittfn, intentsopt)
+	// Void cells left on pages whose files were removed. A page that still
+	// holds used cells was lost, not reclaimed. Reading its cells fails.
+	for i, page := range ff.stream.pages {
+		if page != nil {
+			continue
+		}
+		if n := ff.header.live[int64(i)]; n > 0 {
+			if ff.options.ReadOnly {
+				continue
+			}
+			ff.header.Close()
+			ff.stream.Close()
+			return ErrFlatFile.Errorf("page %d missing with %d used cells: %w",
+				i, n, ErrCorrupted)
+		}
+		if err = ff.header.Reclaim(int64(i), ff.options.PersistentHeader); err != nil {
+			ff.header.Close()
+			ff.stream.Close()
+			return ErrFlatFile.Errorf("stream open error: %w", err)
+		}
+	}
+	// Setup optional changelog, before journal replay logs to it. A
+	// changelog of an earlier session is marked as missing changes of this
+	// one if it is not enabled.
+	if !ff.options.utility && !ff.options.ReadOnly {
+		if ff.options.Changelog {
+			err = ff.openChangelog()
+		} else {
+			err = ff.skipChangelog()
+		}
 		if err != nil {
-			return ErrFlatFile.Errorf("intents error: %w", err)
+			ff.header.Close()
+			ff.stream.Close()
+			return err
+		}
+	}
+	// Setup optional journal. A journal of an earlier session is replayed
+	// and removed if it is not enabled.
+	if !ff.options.utility && !ff.options.ReadOnly {
+		if ff.options.UseJournal {
+			err = ff.openJournal()
+		} else {
+			err = ff.removeJournal()
 		}
-		ff.intents = intents
-		// Check intents.
-		if err = ff.restoreFromIntents(); err != nil {
-			return ErrFlatFile.Errorf("intents load error: %w", err)
+		if err != nil {
+			ff.header.Close()
+			ff.stream.Close()
+			if ff.changelog != nil {
+				ff.changelog.Close()
+				ff.changelog = nil
+			}
+			return err
 		}
 	}
+	// Start optional group commit.
+	ff.header.deferred = false
+	if ff.options.GroupCommit && !ff.options.SyncWrites && !ff.options.utility &&
+		!ff.options.ReadOnly {
+		ff.header.deferred = true
+		ff.startCommitter()
+	}
+	// Start optional background header flushing.
+	ff.header.due = nil
+	if (ff.options.FlushInterval > 0 || ff.options.FlushDirty > 0) &&
+		!ff.options.PersistentHeader && !ff.header.deferred && !ff.options.utility &&
+		!ff.options.ReadOnly {
+		ff.startFlusher()
+	}
+	// Start optional background compaction.
+	if ff.options.CompactInterval > 0 && !ff.options.utility && !ff.options.ReadOnly {
+		ff.startCompactor()
+	}
+	// Start optional background scrubbing.
+	if ff.options.ScrubInterval > 0 && !ff.options.utility {
+		ff.startScrubber()
+	}
 	return
 }
 
 // Close closes the FlatFile.
 func (ff *FlatFile) Close() (err error) {
-	erro := ff.saveOptions()
+	ff.stopCompactor()
+	ff.stopScrubber()
+	ff.stopCommitter()
+	ff.stopFlusher()
+	ff.stopFollower()
+	ff.closeWatchers()
+	erro := error(nil)
+	if !ff.options.ReadOnly {
+		erro = ff.saveOptions()
+	}
 	errh := ff.header.Close()
 	errs := ff.stream.Close()
 	errm := error(nil)
 	if ff.mirror != nil {
+		ff.stopMirrorQueue()
 		errm = ff.mirror.Close()
 	}
-	erri := error(nil)
-	if ff.intents != nil {
-		erri = ff.intents.Close()
+	errc := error(nil)
+	if ff.changelog != nil {
+		errc = ff.changelog.Sync()
+		if err := ff.changelog.Close(); err != nil && errc == nil {
+			errc = err
+		}
+		ff.changelog = nil
+	}
+	errj := error(nil)
+	if ff.journal != nil {
+		// Journal is no longer needed once header is flushed.
+		if errh == nil {
+			errj = ff.journal.Reset()
+		}
+		if err := ff.journal.Close(); err != nil && errj == nil {
+			errj = err
+		}
+		ff.journal = nil
 	}
-	if erro != nil || errh != nil || errs != nil || errm != nil {
+	ff.unlock()
+	if erro != nil || errh != nil || errs != nil || errm != nil || errc != nil ||
+		errj != nil {
 		return ErrFlatFile.Errorf(`close errors: 
-	options: %v
-	header:  %v
-	stream:  %v
-	mirror:  %v
-	intents: %v`,
-			erro, errh, errs, errm, erri)
+	options:   %v
+	header:    %v
+	stream:    %v
+	mirror:    %v
+	changelog: %v
+	journal:   %v`,
+			erro, errh, errs, errm, errc, errj)
 	}
 	return nil
 }
@@ -260,6 +407,9 @@ func (ff *FlatFile) Reopen() (err error) {
 	if err = ff.Close(); err != nil {
 		return
 	}
+	if err = ff.lock(); err != nil {
+		return
+	}
 	if err = ff.load(ff.options.CompactHeader); err != nil {
 		return
 	}
@@ -267,6 +417,9 @@ func (ff *FlatFile) Reopen() (err error) {
 		if err = ff.mirror.Reopen(); err != nil {
 			return ErrFlatFile.Errorf("mirror error: %w", err)
 		}
+		if ff.options.MirrorAsync {
+			ff.startMirrorQueue()
+		}
 	}
 	return
 }
@@ -324,13 +477,23 @@ func (ff *FlatFile) Len() int {
 func (ff *FlatFile) put(key, val []byte) (err error) {
 	// undoputcell undoes states made for putcell.
 	// Mid-put error cleanup.
+	var frag *cell
+	var putpage *page
+	written := false
 	undoputcell := func(c *cell) {
+		if written {
+			ff.markBlobDeleted(putpage, c)
+		}
 		switch c.CellState {
 		case StateNormal:
 			ff.header.Destroy(c)
 		default:
 			ff.header.UnCache(c)
-			c.CRC32 = 0
+			if frag != nil {
+				ff.header.Unsplit(c, frag)
+			}
+			c.clearSum()
+			c.CellState = StateDeleted
 			ff.header.Trash(c)
 		}
 	}
@@ -340,23 +503,31 @@ func (ff *FlatFile) put(key, val []byte) (err error) {
 		return ErrDuplicateKey
 	}
 	// Check if data is bigger than page size.
-	putsize := len(val)
+	data := ff.blobData(key, val)
+	putsize := len(data)
 	if ff.options.MaxPageSize > 0 && int64(putsize) > ff.options.MaxPageSize {
 		return ErrBlobTooBig
 	}
-	// Initialize a cell.
-	putcell := ff.header.Select(!ff.options.Immutable, int64(putsize))
-	putcell.key = string(key)
 	// Generate blob checksum.
+	var sum []byte
 	if ff.options.CRC {
-		putcell.CRC32 = crc32.ChecksumIEEE(val)
+		if sum, err = ff.options.Checksum.Sum(val); err != nil {
+			return ErrFlatFile.Errorf("checksum error: %w", err)
+		}
 	}
+	// Initialize a cell.
+	putcell := ff.header.Select(!ff.options.Immutable, int64(putsize))
+	putcell.key = string(key)
+	putcell.Checksum = ff.options.Checksum
+	putcell.Sum = sum
+	// Split off unused space of a reused cell.
+	frag = ff.header.Split(putcell, ff.options.MinFragmentSize)
 	// Cache cell if requested.
 	if ff.options.MaxCacheMemory > 0 && ff.options.CachedWrites && !ff.options.utility {
 		ff.header.Cache(putcell, val, ff.options.MaxCacheMemory)
 	}
 	// Get page.
-	putpage, err := ff.stream.GetCellPage(
+	putpage, err = ff.stream.GetCellPage(
 		putcell,
 		ff.options.MaxPageSize,
 		ff.options.PreallocatePages,
@@ -366,10 +537,24 @@ func (ff *FlatFile) put(key, val []byte) (err error) {
 		return ErrFlatFile.Errorf("page alloc error: %w", err)
 	}
 	// Write blob.
-	if err := putpage.Put(putcell, val, ff.options.ZeroPadDeleted); err != nil {
+	zeropad := ff.options.ZeroPadDeleted && !ff.options.PunchHoles
+	if err := putpage.Put(putcell, data, zeropad); err != nil {
 		undoputcell(putcell)
 		return ErrFlatFile.Errorf("put error: %w", err)
 	}
+	written = true
+	// Punch unused space of a reused cell, including split off space.
+	if ff.options.PunchHoles && putcell.CellState != StateNormal {
+		end := putcell.BlobEndPos()
+		if frag != nil {
+			end = frag.BlobEndPos()
+		}
+		unused := putcell.Offset + putcell.Used
+		if err := putpage.Punch(unused, end-unused); err != nil {
+			undoputcell(putcell)
+			return ErrFlatFile.Errorf("put error: %w", err)
+		}
+	}
 	// Update header file.
 	if err := ff.header.Update(putcell, ff.options.PersistentHeader); err != nil {
 		undoputcell(putcell)
@@ -377,28 +562,45 @@ func (ff *FlatFile) put(key, val []byte) (err error) {
 	}
 	// Append the cell.
 	ff.header.Use(putcell)
+	// Store and trash the split off cell.
+	if frag != nil {
+		if err := ff.header.Update(frag, ff.options.PersistentHeader); err != nil {
+			ff.header.Endirty(frag)
+		}
+		ff.header.Trash(frag)
+	}
 	return
 }
 
 // Put puts val into FlatFile under key or returns an error if one occurs.
 func (ff *FlatFile) Put(key, val []byte) error {
+	return ff.PutWith(key, val, PutOpts{})
+}
 
+// PutWith puts val into FlatFile under key with opts or returns an error if
+// one occurs.
+func (ff *FlatFile) PutWith(key, val []byte, opts PutOpts) (err error) {
+
+	if ff.options.ReadOnly {
+		return ErrReadOnly
+	}
 	if len(key) == 0 {
 		return ErrInvalidKey
 	}
 
+	defer ff.settle(opts.Durability, &err)
 	ff.mutex.Lock()
 	defer ff.mutex.Unlock()
 
-	if err := ff.put(key, val); err != nil {
-		return err
+	if ff.header.IsKeyUsed(key) {
+		return ErrDuplicateKey
 	}
-	if ff.mirror != nil {
-		if err := ff.mirror.Put(key, val); err != nil {
-			return ErrFlatFile.Errorf("mirror error: %w", err)
-		}
+	seq, err := ff.journalBegin(journalPut, key, val, nil, false)
+	if err != nil {
+		return err
 	}
-	return nil
+	err = ff.put(key, val)
+	return ff.complete(seq, journalPut, key, val, err)
 }
 
 // get is the Get implementation.
@@ -411,19 +613,25 @@ func (ff *FlatFile) get(key []byte, cache bool) (blob []byte, err error) {
 	// Retrieve blob.
 	if cell.cache != nil {
 		// From cache.
-		blob = make([]byte, cell.Used)
+		blob = make([]byte, len(cell.cache))
 		copy(blob, cell.cache)
 	} else {
 		// From page.
 		page := ff.stream.Page(cell)
-		blob, err = page.Get(cell)
+		if page == nil {
+			return nil, ErrFlatFile.Errorf("get error: page %d missing: %w",
+				cell.PageIndex, ErrCorrupted)
+		}
+		data, err := page.Get(cell)
 		if err != nil {
 			return nil, ErrFlatFile.Errorf("get error: %w", err)
 		}
-		if ff.options.CRC && cell.CRC32 != 0 {
-			crc := crc32.ChecksumIEEE(blob)
-			if crc != cell.CRC32 {
-				return nil, ErrChecksumFailed
+		if blob, err = ff.blobValue(key, data); err != nil {
+			return nil, ErrFlatFile.Errorf("get error: %w", err)
+		}
+		if ff.options.CRC {
+			if err := cell.verify(blob); err != nil {
+				return nil, err
 			}
 		}
 	}
@@ -441,7 +649,7 @@ func (ff *FlatFile) get(key []byte, cache bool) (blob []byte, err error) {
 	}
 	// Set cache if empty.
 	if cell.cache == nil {
-		cell.cache = make([]byte, cell.Used)
+		cell.cache = make([]byte, len(blob))
 		copy(cell.cache, blob)
 	}
 	ff.header.Cache(cell, blob, ff.options.MaxCacheMemory)
@@ -463,9 +671,20 @@ func (ff *FlatFile) Get(key []byte) (blob []byte, err error) {
 }
 
 // Modify modifies an existing blob specified under key by replacing it with
-// specified val. If an error occurs it is returned.
-func (ff *FlatFile) Modify(key, val []byte) (err error) {
+// specified val. If an error occurs it is returned. If val could not be
+// stored the old blob is restored, unless it failed verification in which
+// case the key is deleted.
+func (ff *FlatFile) Modify(key, val []byte) error {
+	return ff.ModifyWith(key, val, PutOpts{})
+}
+
+// ModifyWith modifies an existing blob specified under key by replacing it
+// with specified val with opts. If an error occurs it is returned.
+func (ff *FlatFile) ModifyWith(key, val []byte, opts PutOpts) (err error) {
 	// Check params.
+	if ff.options.ReadOnly {
+		return ErrReadOnly
+	}
 	if ff.options.Immutable {
 		return ErrImmutableFile
 	}
@@ -473,6 +692,7 @@ func (ff *FlatFile) Modify(key, val []byte) (err error) {
 		return ErrInvalidKey
 	}
 	// Lock wrap.
+	defer ff.settle(opts.Durability, &err)
 	ff.mutex.Lock()
 	defer ff.mutex.Unlock()
 	// Get cell.
@@ -484,47 +704,39 @@ func (ff *FlatFile) Modify(key, val []byte) (err error) {
 	if ff.options.MaxPageSize > 0 && int64(len(val)) > ff.options.MaxPageSize {
 		return ErrBlobTooBig
 	}
-	// Store intent.
-	var blob []byte
-	if ff.options.UseIntents {
-		if cell.Cached() {
-			blob = cell.cache
-		} else {
-			blob, err = ff.get(key, false)
-			if err != nil {
-				return ErrFlatFile.Errorf("failed getting cell blob for intent: %w", err)
-			}
-		}
-		if err := ff.intents.Put(key, blob); err != nil {
-			return ErrFlatFile.Errorf("intents put error: %w", err)
+	// Old value, restored if put of val fails.
+	old, hasOld, err := ff.oldValue(key, cell)
+	if err != nil {
+		return err
+	}
+	// Journal.
+	var seq uint64
+	if ff.journal != nil {
+		if seq, err = ff.journalBegin(journalModify, key, val, old, hasOld); err != nil {
+			return err
 		}
 	}
+	err = ff.modify(key, val, old, hasOld)
+	return ff.complete(seq, journalModify, key, val, err)
+}
+
+// modify is the Modify implementation. It replaces blob of key with val and
+// restores old, if hasOld, if that fails.
+func (ff *FlatFile) modify(key, val, old []byte, hasOld bool) error {
 	// Delete key.
-	err = ff.delete(key)
-	if err != nil {
-		return
+	if err := ff.delete(key); err != nil {
+		return err
 	}
 	// Put key again with new value.
-	if err := ff.put(key, val); err != nil {
-		// Restore deleted cell.
-		if err := ff.put(key, blob); err != nil {
-			ErrFlatFile.Errorf("restore cell error: %w", err)
-		}
+	err := ff.put(key, val)
+	if err == nil || !hasOld {
 		return err
 	}
-	// Remove intent.
-	if ff.options.UseIntents {
-		if err := ff.intents.Delete(key); err != nil {
-			return ErrFlatFile.Errorf("intents error: %w", err)
-		}
+	// Restore deleted cell.
+	if errr := ff.put(key, old); errr != nil {
+		return ErrFlatFile.Errorf("modify error: %v, restore error: %w", err, errr)
 	}
-	// Update mirror.
-	if ff.mirror != nil {
-		if err := ff.mirror.Modify(key, val); err != nil {
-			return ErrFlatFile.Errorf("mirror error: %w", err)
-		}
-	}
-	return nil
+	return err
 }
 
 // delete is Delete implementation.
@@ -534,20 +746,72 @@ func (ff *FlatFile) delete(key []byte) (err error) {
 	if !ok {
 		return ErrKeyNotFound
 	}
-	delete(ff.header.keys, string(key))
+	return ff.discard(cell)
+}
+
+// discard marks a used cell as deleted.
+func (ff *FlatFile) discard(cell *cell) (err error) {
+
+	live := ff.header.Release(cell)
 	ff.header.UnCache(cell)
 	ff.header.Trash(cell)
 	cell.key = ""
-	cell.CRC32 = 0
+	cell.clearSum()
 	cell.CellState = StateDeleted
 
-	return ff.header.Update(cell, ff.options.PersistentHeader)
+	if err = ff.header.Update(cell, ff.options.PersistentHeader); err != nil {
+		return
+	}
+	// Reclaim page if empty.
+	if live == 0 && ff.options.ReclaimPages {
+		return ff.reclaim(cell.PageIndex)
+	}
+	// Punch deleted cell space.
+	if ff.options.PunchHoles {
+		if err = ff.stream.Page(cell).Punch(cell.Offset, cell.Allocated); err != nil {
+			return ErrFlatFile.Errorf("delete error: %w", err)
+		}
+		return
+	}
+	// Mark stream record as deleted.
+	if err = ff.markBlobDeleted(ff.stream.Page(cell), cell); err != nil {
+		return ErrFlatFile.Errorf("delete error: %w", err)
+	}
+	return
+}
+
+// reclaim voids all cells on page specified by pageidx then removes the page
+// file. Last page is never reclaimed.
+func (ff *FlatFile) reclaim(pageidx int64) error {
+	if int(pageidx) >= len(ff.stream.pages)-1 {
+		return nil
+	}
+	if err := ff.header.Reclaim(pageidx, ff.options.PersistentHeader); err != nil {
+		return ErrFlatFile.Errorf("reclaim error: %w", err)
+	}
+	// Page must not be gone while header on disk still holds its cells.
+	if err := ff.header.Sync(); err != nil {
+		return ErrFlatFile.Errorf("reclaim error: %w", err)
+	}
+	if err := ff.stream.Remove(pageidx); err != nil {
+		return ErrFlatFile.Errorf("reclaim error: %w", err)
+	}
+	return nil
 }
 
 // Delete marks a blob specified under key as deleted. If an error occurs it
 // is returned.
 func (ff *FlatFile) Delete(key []byte) error {
+	return ff.DeleteWith(key, PutOpts{})
+}
+
+// DeleteWith marks a blob specified under key as deleted with opts. If an
+// error occurs it is returned.
+func (ff *FlatFile) DeleteWith(key []byte, opts PutOpts) (err error) {
 
+	if ff.options.ReadOnly {
+		return ErrReadOnly
+	}
 	if ff.options.Immutable {
 		return ErrImmutableFile
 	}
@@ -555,23 +819,44 @@ func (ff *FlatFile) Delete(key []byte) error {
 		return ErrInvalidKey
 	}
 
+	defer ff.settle(opts.Durability, &err)
 	ff.mutex.Lock()
 	defer ff.mutex.Unlock()
 
-	err := ff.delete(key)
-	if err != nil {
-		return err
-	}
-	if ff.mirror != nil {
-		if err := ff.mirror.Delete(key); err != nil {
-			return ErrFlatFile.Errorf("mirror error: %w", err)
+	// Journal.
+	var seq uint64
+	if ff.journal != nil {
+		cell, ok := ff.header.Cell(key)
+		if !ok {
+			return ErrKeyNotFound
+		}
+		old, hasOld, err := ff.oldValue(key, cell)
+		if err != nil {
+			return err
+		}
+		if seq, err = ff.journalBegin(journalDelete, key, nil, old, hasOld); err != nil {
+			return err
 		}
 	}
-	return nil
+	err = ff.delete(key)
+	return ff.complete(seq, journalDelete, key, nil, err)
 }
 
 // Clear clears the FlatFile.
 func (ff *FlatFile) Clear() error {
+	if ff.options.ReadOnly {
+		return ErrReadOnly
+	}
+	// Compaction moves cells between pages across lock releases so it is
+	// stopped for the duration of the clear.
+	if ff.compactor != nil {
+		ff.stopCompactor()
+		defer ff.startCompactor()
+	}
+
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
 	errh := ff.header.Clear()
 	errs := ff.stream.Clear()
 	if errh != nil || errs != nil {
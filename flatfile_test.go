@@ -5,6 +5,9 @@
 package flatfile
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"testing"
 
@@ -29,7 +32,7 @@ func TestFlatFileBasicRW(t *testing.T) {
 	options := NewOptions()
 	options.PreallocatePages = true
 	options.MaxPageSize = 1024
-	options.UseIntents = true
+	options.UseJournal = true
 	ff, err := Open(testdir, options)
 	if err != nil {
 		t.Fatal(err)
@@ -275,6 +278,258 @@ func TestKeys(t *testing.T) {
 	}
 }
 
+// TestSplit checks that unused space of a reused cell is split off
+// into a new deleted cell and reused.
+func TestSplit(t *testing.T) {
+
+	testdir := "test/split"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.MinFragmentSize = 16
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := make([]byte, 1024)
+	if err := ff.Put([]byte("big"), big); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Put([]byte("tail"), []byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Delete([]byte("big")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Put([]byte("small"), []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	if ff.header.trash.Len() != 1 {
+		t.Fatalf("split failed, want 1 deleted cell, got %d", ff.header.trash.Len())
+	}
+	if err := ff.Put([]byte("medium"), make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	cell, _ := ff.header.Cell([]byte("medium"))
+	if cell.PageIndex != 0 || cell.Offset != 5 {
+		t.Fatalf("split failed, want fragment reused at offset 5, got %d", cell.Offset)
+	}
+
+	if err := ff.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	for key, size := range map[string]int{"tail": 4, "small": 5, "medium": 512} {
+		blob, err := ff.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(blob) != size {
+			t.Fatalf("split failed, want %d bytes, got %d", size, len(blob))
+		}
+	}
+	if ff.header.trash.Len() != 1 {
+		t.Fatalf("split failed, want 1 deleted cell, got %d", ff.header.trash.Len())
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPunchHoles checks that space of deleted cells is deallocated or
+// zeroed and that adjacent cells are left intact.
+func TestPunchHoles(t *testing.T) {
+
+	testdir := "test/punchholes"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.PunchHoles = true
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+
+	big := bytes.Repeat([]byte{0xFF}, 65536)
+	if err := ff.Put([]byte("big"), big); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Put([]byte("tail"), []byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	cell, _ := ff.header.Cell([]byte("big"))
+	if err := ff.Delete([]byte("big")); err != nil {
+		t.Fatal(err)
+	}
+	blob := make([]byte, cell.Allocated)
+	if _, err := ff.stream.Page(cell).file.ReadAt(blob, cell.Offset); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(blob, make([]byte, cell.Allocated)) {
+		t.Fatal("punch holes failed, deleted space not zeroed")
+	}
+	val, err := ff.Get([]byte("tail"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "tail" {
+		t.Fatalf("punch holes failed, want 'tail', got '%s'", string(val))
+	}
+}
+
+// TestPrealloc checks page preallocation modes and chunked growth.
+func TestPrealloc(t *testing.T) {
+
+	testdir := "test/prealloc"
+	defer os.RemoveAll(testdir)
+
+	for _, mode := range []PreallocMode{PreallocSparse, PreallocReserve, PreallocZero} {
+		for _, chunk := range []int64{0, 4096} {
+			os.RemoveAll(testdir)
+			options := NewOptions()
+			options.MaxPageSize = 65536
+			options.PreallocMode = mode
+			options.PreallocChunkSize = chunk
+			ff, err := Open(testdir, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []int64{65536, 65536}
+			if chunk > 0 {
+				want = []int64{4096, 8192}
+			}
+			for i, size := range []int{100, 5000} {
+				if err := ff.Put([]byte(fmt.Sprintf("key%d", i)), make([]byte, size)); err != nil {
+					t.Fatal(err)
+				}
+				fi, err := ff.stream.pages[0].file.Stat()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Size() != want[i] {
+					t.Fatalf("prealloc mode %d, chunk %d failed, want size %d, got %d",
+						mode, chunk, want[i], fi.Size())
+				}
+			}
+			if err := ff.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestReclaimPages checks that pages whose cells are all deleted are
+// removed and that the file opens without them.
+func TestReclaimPages(t *testing.T) {
+
+	testdir := "test/reclaimpages"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.MaxPageSize = 1024
+	options.ReclaimPages = true
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"key0", "key1", "key2"}
+	for _, key := range keys {
+		if err := ff.Put([]byte(key), make([]byte, 600)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ff.stream.pages) != 3 {
+		t.Fatalf("reclaim failed, want 3 pages, got %d", len(ff.stream.pages))
+	}
+	filename := ff.stream.pages[0].filename
+	if err := ff.Delete([]byte("key0")); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := FileExists(filename); exists {
+		t.Fatal("reclaim failed, page file not removed")
+	}
+	if ff.header.trash.Len() != 0 {
+		t.Fatalf("reclaim failed, want 0 deleted cells, got %d", ff.header.trash.Len())
+	}
+
+	if err := ff.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys[1:] {
+		if _, err := ff.Get([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ff.Put([]byte("key3"), make([]byte, 600)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMissingPage checks that a lost page that still holds used cells is
+// reported as corruption, not as a reclaimed page.
+func TestMissingPage(t *testing.T) {
+
+	testdir := "test/missingpage"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.MaxPageSize = 1024
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"key0", "key1", "key2"}
+	for _, key := range keys {
+		if err := ff.Put([]byte(key), make([]byte, 600)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filename := ff.stream.pages[0].filename
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Open(testdir, options); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("want ErrCorrupted, got %v", err)
+	}
+	readonly := NewOptions()
+	readonly.ReadOnly = true
+	if ff, err = Open(testdir, readonly); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ff.Get([]byte("key0")); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("want ErrCorrupted, got %v", err)
+	}
+	if _, err := ff.Get([]byte("key1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Repair(testdir); err != nil {
+		t.Fatal(err)
+	}
+	if ff, err = Open(testdir, options); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func benchmarkGet(b *testing.B, options *Options) {
 
 	b.StopTimer()
@@ -514,15 +769,45 @@ func BenchmarkModifyNoHeaderUpdate(b *testing.B) {
 	benchmarkModify(b, options)
 }
 
-func BenchmarkModifyIntent(b *testing.B) {
+func BenchmarkModifyJournal(b *testing.B) {
 	options := NewOptions()
-	options.UseIntents = true
+	options.UseJournal = true
 	benchmarkModify(b, options)
 }
 
-func BenchmarkModifyNoHeaderUpdateIntent(b *testing.B) {
+func BenchmarkModifyNoHeaderUpdateJournal(b *testing.B) {
 	options := NewOptions()
 	options.PersistentHeader = false
-	options.UseIntents = true
+	options.UseJournal = true
 	benchmarkModify(b, options)
 }
+
+func TestModifyRestore(t *testing.T) {
+
+	testdir := "test/modifyrestore"
+	for _, journal := range []bool{false, true} {
+		os.RemoveAll(testdir)
+		options := NewOptions()
+		options.UseJournal = journal
+		options.MaxPageSize = 1024
+		options.StreamRecords = true
+		ff, err := Open(testdir, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ff.Put([]byte("key"), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+		// Fits the page but not with the stream record around it.
+		if err := ff.Modify([]byte("key"), make([]byte, 1024)); !errors.Is(err, ErrBlobTooBig) {
+			t.Fatalf("journal %t: want ErrBlobTooBig, got %v", journal, err)
+		}
+		if blob, err := ff.Get([]byte("key")); err != nil || string(blob) != "val" {
+			t.Fatalf("journal %t: want 'val', got '%s' (%v)", journal, blob, err)
+		}
+		if err := ff.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.RemoveAll(testdir)
+}
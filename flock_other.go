@@ -0,0 +1,17 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package flatfile
+
+import (
+	"os"
+)
+
+// flock is not supported on this platform and does nothing.
+func flock(file *os.File, exclusive bool) error {
+	return nil
+}
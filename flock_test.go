@@ -0,0 +1,82 @@
+package flatfile
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockReadOnly(t *testing.T) {
+
+	testdir := "test/lockreadonly"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	ff, err := Open(testdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Put([]byte("key"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	readonly := NewOptions()
+	readonly.ReadOnly = true
+	if _, err := Open(testdir, nil); !errors.Is(err, ErrLocked) {
+		t.Fatalf("lock failed, second writer opened: %v", err)
+	}
+	if _, err := Open(testdir, readonly); !errors.Is(err, ErrLocked) {
+		t.Fatalf("lock failed, reader opened with writer: %v", err)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	base := filepath.Join(testdir, filepath.Base(testdir))
+	header, err := ioutil.ReadFile(base + "." + HeaderExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options, err := ioutil.ReadFile(base + "." + OptionsExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var readers []*FlatFile
+	for i := 0; i < 2; i++ {
+		opts := NewOptions()
+		opts.ReadOnly = true
+		ff, err := Open(testdir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, ff)
+		val, err := ff.Get([]byte("key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != "val" {
+			t.Fatalf("read-only get failed, want 'val', got '%s'", val)
+		}
+		if err := ff.Put([]byte("new"), []byte("new")); err != ErrReadOnly {
+			t.Fatalf("read-only put did not fail: %v", err)
+		}
+	}
+	if _, err := Open(testdir, nil); !errors.Is(err, ErrLocked) {
+		t.Fatalf("lock failed, writer opened with readers: %v", err)
+	}
+	for _, ff := range readers {
+		if err := ff.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if data, _ := ioutil.ReadFile(base + "." + HeaderExt); !bytes.Equal(data, header) {
+		t.Fatal("read-only session modified the header")
+	}
+	if data, _ := ioutil.ReadFile(base + "." + OptionsExt); !bytes.Equal(data, options) {
+		t.Fatal("read-only session modified the options")
+	}
+}
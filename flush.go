@@ -0,0 +1,91 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"time"
+)
+
+// flusher runs background header flushing.
+type flusher struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Sync commits the FlatFile to stable storage: it syncs the journal and the
+// pages, writes header records held in memory and syncs the header, then
+// does the same for the mirror, if one is configured.
+func (ff *FlatFile) Sync() error {
+	return ff.commit()
+}
+
+// flush writes header records held in memory to the header file of the
+// FlatFile and its synchronous mirror. Journal is reset if it grew past
+// journalResetSize, unless header records are queued for group commit.
+func (ff *FlatFile) flush() error {
+
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	if err := ff.header.Flush(); err != nil {
+		return err
+	}
+	if ff.journal != nil && !ff.header.deferred && ff.journal.size > journalResetSize {
+		if err := ff.journal.Reset(); err != nil {
+			return err
+		}
+	}
+	// Asynchronous mirror is behind and syncs as it applies queued writes.
+	if ff.mirror != nil && ff.mirrorQueue == nil {
+		if err := ff.mirror.flush(); err != nil {
+			return ErrFlatFile.Errorf("mirror error: %w", err)
+		}
+	}
+	return nil
+}
+
+// startFlusher starts background header flushing.
+func (ff *FlatFile) startFlusher() {
+	ff.flusher = &flusher{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	due := make(chan struct{}, 1)
+	ff.header.threshold = ff.options.FlushDirty
+	ff.header.due = due
+	go ff.runFlusher(ff.flusher, due)
+}
+
+// stopFlusher stops background header flushing, if running, and waits for
+// it to finish.
+func (ff *FlatFile) stopFlusher() {
+	if ff.flusher == nil {
+		return
+	}
+	close(ff.flusher.stop)
+	<-ff.flusher.done
+	ff.flusher = nil
+}
+
+// runFlusher flushes the header each FlushInterval and each time due is
+// signaled until f is stopped.
+func (ff *FlatFile) runFlusher(f *flusher, due <-chan struct{}) {
+	defer close(f.done)
+	var tick <-chan time.Time
+	if ff.options.FlushInterval > 0 {
+		ticker := time.NewTicker(ff.options.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-tick:
+		case <-due:
+		}
+		ff.flush()
+	}
+}
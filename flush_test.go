@@ -0,0 +1,62 @@
+package flatfile
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBackgroundFlush(t *testing.T) {
+
+	testdir := "test/backgroundflush"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.PersistentHeader = false
+	options.FlushDirty = 10
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if err := ff.Put(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		ff.mutex.RLock()
+		dirty := len(ff.header.dirty)
+		ff.mutex.RUnlock()
+		if dirty == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background flush failed, header not flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Sync, then crash.
+	if err := ff.Put([]byte("synced"), []byte("synced")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	ff.stopFlusher()
+	ff.header.file.Close()
+	ff.stream.Close()
+	ff.unlock()
+
+	ff, err = Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	if ff.Len() != 11 {
+		t.Fatalf("background flush failed, want 11 keys, got %d", ff.Len())
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// follower runs background following of the header.
+type follower struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// OpenFollower opens an existing FlatFile in the base directory of filename
+// as a follower of a writer that has it open in another process. Follower
+// is opened read-only, see Options.ReadOnly, but without locking, and polls
+// the header every FollowInterval for records appended by the writer and
+// applies them to its keys. Several followers can serve Get, Walk and Keys
+// from the same files while the writer owns updates.
+//
+// Follower sees changes once the writer has written their header records,
+// immediately if the writer has PersistentHeader enabled. Between polls a
+// follower serves the previous state. A blob the writer has since deleted
+// and overwritten fails checksum verification if CRC is enabled. Header is
+// reloaded in whole when the writer replaces or truncates it, for instance
+// on checkpoint. Errors of background polls are reported to the function
+// set with SetFollowError. Options are not modified. Close() MUST be called
+// after use.
+func OpenFollower(filename string, options *Options) (*FlatFile, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+	opts := *options
+	opts.ReadOnly = true
+	opts.follower = true
+	ff, err := Open(filename, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if ff.followed, err = ff.header.followInfo(); err != nil {
+		ff.Close()
+		return nil, err
+	}
+	if ff.options.FollowInterval > 0 {
+		ff.startFollower()
+	}
+	return ff, nil
+}
+
+// SetFollowError sets f as the function that receives errors of background
+// polls of a FlatFile opened with OpenFollower. A failed poll is retried on
+// the next one. f is called without FlatFile locks held.
+func (ff *FlatFile) SetFollowError(f func(error)) {
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+	ff.onFollow = f
+}
+
+// Refresh applies header records appended by the writer since last Refresh
+// to a FlatFile opened with OpenFollower. It does nothing otherwise.
+func (ff *FlatFile) Refresh() error {
+
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	if ff.followed == nil {
+		return nil
+	}
+	return ff.follow()
+}
+
+// follow applies header records appended since last follow or reloads the
+// header if it was replaced or truncated, then opens new pages.
+func (ff *FlatFile) follow() error {
+	reload, err := ff.header.replaced(ff.followed)
+	if err != nil {
+		return err
+	}
+	if !reload {
+		if err = ff.header.tail(); err != nil {
+			reload = true
+		}
+	}
+	if reload {
+		if err = ff.reloadHeader(); err != nil {
+			return err
+		}
+	}
+	// Open pages created since.
+	maxpage := int64(-1)
+	ff.header.cells.Walk(func(c *cell) bool {
+		if c.PageIndex > maxpage {
+			maxpage = c.PageIndex
+		}
+		return true
+	})
+	if n := maxpage + 1 - int64(len(ff.stream.pages)); n > 0 {
+		if err = ff.stream.Open(n, false); err != nil {
+			return ErrFlatFile.Errorf("follow error: %w", err)
+		}
+	}
+	return nil
+}
+
+// reloadHeader reloads the header in whole.
+func (ff *FlatFile) reloadHeader() error {
+	h := newHeader(ff.header.filename)
+	h.policy = ff.header.policy
+	h.readonly = true
+	if _, err := h.Open(false, false); err != nil {
+		if h.file != nil {
+			h.file.Close()
+		}
+		return ErrFlatFile.Errorf("follow reload error: %w", err)
+	}
+	info, err := h.followInfo()
+	if err != nil {
+		h.Close()
+		return err
+	}
+	ff.header.Close()
+	ff.header = h
+	ff.followed = info
+	return nil
+}
+
+// followInfo describes header and checkpoint files being followed.
+type followInfo struct {
+	// header is the followed header file info.
+	header os.FileInfo
+	// checkpoint is the checkpoint file info, nil if none.
+	checkpoint os.FileInfo
+}
+
+// followInfo returns info of the header and checkpoint files.
+func (h *header) followInfo() (*followInfo, error) {
+	info := &followInfo{}
+	var err error
+	if info.header, err = h.file.Stat(); err != nil {
+		return nil, ErrFlatFile.Errorf("header stat error: %w", err)
+	}
+	if info.checkpoint, err = os.Stat(h.checkpoint); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, ErrFlatFile.Errorf("checkpoint stat error: %w", err)
+		}
+		info.checkpoint = nil
+	}
+	return info, nil
+}
+
+// replaced returns truth if header file was replaced or truncated or the
+// checkpoint changed since info.
+func (h *header) replaced(info *followInfo) (bool, error) {
+	fi, err := os.Stat(h.filename)
+	if err != nil {
+		return false, ErrFlatFile.Errorf("header stat error: %w", err)
+	}
+	if !os.SameFile(fi, info.header) || fi.Size() < h.end {
+		return true, nil
+	}
+	ci, err := os.Stat(h.checkpoint)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, ErrFlatFile.Errorf("checkpoint stat error: %w", err)
+	}
+	if (ci == nil) != (info.checkpoint == nil) {
+		return true, nil
+	}
+	if ci != nil && (!os.SameFile(ci, info.checkpoint) ||
+		!ci.ModTime().Equal(info.checkpoint.ModTime())) {
+		return true, nil
+	}
+	return false, nil
+}
+
+// tail reads cell records appended to header file past end and applies
+// them. An incomplete last record is left to be read by next tail.
+func (h *header) tail() error {
+	fi, err := h.file.Stat()
+	if err != nil {
+		return ErrFlatFile.Errorf("header stat error: %w", err)
+	}
+	if fi.Size() <= h.end {
+		return nil
+	}
+	if _, err = h.file.Seek(h.end, os.SEEK_SET); err != nil {
+		return ErrFlatFile.Errorf("header seek error: %w", err)
+	}
+	rr := newRecordReader(h.file, h.end, fi.Size())
+	for {
+		off := rr.Offset()
+		typ, payload, err := rr.Next()
+		if errors.Is(err, io.EOF) || errors.Is(err, errTornRecord) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if typ != recordCell {
+			return ErrFlatFile.Errorf(
+				"record at offset %d: unexpected type %d: %w", off, typ, ErrCorrupted)
+		}
+		c := &cell{}
+		if err = c.read(payload, FormatVersion); err != nil {
+			return ErrFlatFile.Errorf("record at offset %d: %v: %w", off, err, ErrCorrupted)
+		}
+		h.apply(c)
+		h.end = rr.Offset()
+	}
+}
+
+// apply applies cell c read from a header record to header state, replacing
+// the cell with the same CellID, if any.
+func (h *header) apply(c *cell) {
+	if old, ok := h.cells.cells[c.CellID]; ok {
+		if cur, ok := h.keys[old.key]; ok && cur == old {
+			h.Release(old)
+		}
+		h.UnCache(old)
+		h.cells.Destroy(old)
+	}
+	switch c.CellState {
+	case StateReclaimed:
+		return
+	case StateNormal, StateReused:
+		h.cells.Mask(c)
+		// If a relocated cell's previous copy is still used under the same
+		// key the newer one wins.
+		if prev, ok := h.keys[c.key]; ok {
+			if prev.CellID > c.CellID {
+				return
+			}
+			h.UnCache(prev)
+			h.Release(prev)
+		}
+		h.Use(c)
+	default:
+		h.cells.Mask(c)
+	}
+}
+
+// startFollower starts background following of the header.
+func (ff *FlatFile) startFollower() {
+	ff.follower = &follower{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go ff.runFollower(ff.follower)
+}
+
+// stopFollower stops background following, if running, and waits for it to
+// finish.
+func (ff *FlatFile) stopFollower() {
+	if ff.follower == nil {
+		return
+	}
+	close(ff.follower.stop)
+	<-ff.follower.done
+	ff.follower = nil
+}
+
+// runFollower follows the header each FollowInterval until f is stopped.
+func (ff *FlatFile) runFollower(f *follower) {
+	defer close(f.done)
+	ticker := time.NewTicker(ff.options.FollowInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			if err := ff.Refresh(); err != nil {
+				ff.followError(err)
+			}
+		}
+	}
+}
+
+// followError reports background follow error err.
+func (ff *FlatFile) followError(err error) {
+	ff.mutex.RLock()
+	f := ff.onFollow
+	ff.mutex.RUnlock()
+	if f != nil {
+		f(err)
+	}
+}
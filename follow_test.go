@@ -0,0 +1,140 @@
+package flatfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFollower(t *testing.T) {
+
+	testdir := "test/follower"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.MaxPageSize = 1024
+	options.CheckpointRecords = 50
+	writer, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	if err := writer.Put([]byte("first"), []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	followopts := NewOptions()
+	followopts.FollowInterval = 0
+	follower, err := OpenFollower(testdir, followopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	if err := follower.Put([]byte("key"), []byte("val")); err != ErrReadOnly {
+		t.Fatalf("follower put did not fail: %v", err)
+	}
+
+	want := map[string]string{"first": "first"}
+	check := func() {
+		if err := follower.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if follower.Len() != len(want) {
+			t.Fatalf("follow failed, want %d keys, got %d", len(want), follower.Len())
+		}
+		for key, val := range want {
+			blob, err := follower.Get([]byte(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(blob) != val {
+				t.Fatalf("follow failed, key '%s' want '%s', got '%s'", key, val, blob)
+			}
+		}
+	}
+	check()
+
+	// Enough records to add pages and checkpoint.
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("key%d", i)
+		val := fmt.Sprintf("%s.%0100d", key, i)
+		if err := writer.Put([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+		switch {
+		case i%7 == 0:
+			if err := writer.Delete([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, key)
+		case i%5 == 0:
+			val = "modified." + key
+			if err := writer.Modify([]byte(key), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = val
+		}
+		if i%10 == 0 {
+			check()
+		}
+	}
+	check()
+}
+
+func TestFollowerError(t *testing.T) {
+
+	testdir := "test/followererror"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	writer, err := Open(testdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Put([]byte("key"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	options := NewOptions()
+	options.FollowInterval = 10 * time.Millisecond
+	follower, err := OpenFollower(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	if options.ReadOnly || options.follower {
+		t.Fatal("follower modified caller's options")
+	}
+	errs := make(chan error, 1)
+	follower.SetFollowError(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+
+	// Header disappears under the follower.
+	fn := filepath.Join(testdir, "followererror."+HeaderExt)
+	if err := os.Rename(fn, fn+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("want os.ErrNotExist, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("follow error not reported")
+	}
+	if err := os.Rename(fn+".moved", fn); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,9 +5,14 @@
 package flatfile
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/vedranvuk/binaryex"
 )
@@ -18,6 +23,16 @@ type header struct {
 	// filename is the full path to header file.
 	filename string
 
+	// checkpoint is the full path to checkpoint file.
+	checkpoint string
+
+	// interval is the number of records written to header file after which
+	// a checkpoint is made. If <= 0, checkpoints are not made.
+	interval int64
+
+	// records is the number of records written since last checkpoint.
+	records int64
+
 	// file is the underlying header file.
 	file *os.File
 
@@ -31,28 +46,67 @@ type header struct {
 	cache *mem
 
 	// trash holds and manages deleted cells.
-	trash *bin
+	trash allocator
+
+	// policy is the allocation policy of trash.
+	policy AllocPolicy
 
 	// dirty holds cells that are in-memory only.
 	dirty map[CellID]*cell
 
+	// deferred specifies if immediate updates are deferred to next Flush.
+	deferred bool
+
+	// readonly specifies if header file is opened read-only. Updates are
+	// kept in memory only.
+	readonly bool
+
+	// end is the offset past the last complete record in header file when
+	// loaded or last followed.
+	end int64
+
+	// threshold is the number of dirty cells at which due is signaled.
+	threshold int
+
+	// due, if not nil, is signaled when dirty cells reach threshold.
+	due chan struct{}
+
 	// lastKey holds the key of last inserted cell.
 	lastKey string
 
 	// keys maps a key to a cell.
 	keys map[string]*cell
+
+	// live holds the number of used cells per page index.
+	live map[int64]int64
+
+	// used holds the allocated size of used cells per page index.
+	used map[int64]int64
+
+	// fenced holds indexes of pages whose deleted cells are kept out of
+	// trash so they are not reused.
+	fenced map[int64]bool
+	// pending holds cells deleted while updates are deferred. They are kept
+	// out of trash until their records are synced, see Committed, so that
+	// their space is not reused while the header file on disk still
+	// assigns it to a key.
+	pending map[CellID]*cell
 }
 
 // newHeader creates a new header with specified filename.
 func newHeader(filename string) (h *header) {
 	h = &header{
-		filename: filename,
+		filename:   filename,
+		checkpoint: strings.TrimSuffix(filename, "."+HeaderExt) + "." + CheckpointExt,
 	}
 	return h
 }
 
 // hdr is the .header signature.
-var hdr = []byte{0xF1, 0x47, 0xF1, 0x13}
+var hdr = []byte{0xF1, 0x47, 0xF1, 0x14}
+
+// hdrLegacy is the signature of a .header with unframed records.
+var hdrLegacy = []byte{0xF1, 0x47, 0xF1, 0x13}
 
 // Open opens the header file and loads it or creates it if it doesn't exist.
 // Returns index of last stream page that needs to be opened or an error.
@@ -62,20 +116,31 @@ func (h *header) Open(compactheader, sync bool) (lastpage int64, err error) {
 	if sync {
 		opt = opt | os.O_SYNC
 	}
+	if h.readonly {
+		opt = os.O_RDONLY
+		compactheader = false
+	}
 	h.file, err = os.OpenFile(h.filename, opt, os.ModePerm)
 	if err != nil {
 		return
 	}
-	if _, err = h.file.Write(hdr[0:]); err != nil {
+	fi, err := h.file.Stat()
+	if err != nil {
 		return
 	}
-	if _, err = h.file.Seek(0, 0); err != nil {
-		return
+	if fi.Size() == 0 && !h.readonly {
+		if err = writeSignature(h.file); err != nil {
+			return
+		}
 	}
 	h.cells = newPot()
 	h.keys = make(map[string]*cell)
+	h.live = make(map[int64]int64)
+	h.used = make(map[int64]int64)
+	h.fenced = make(map[int64]bool)
+	h.pending = make(map[CellID]*cell)
 	h.dirty = make(map[CellID]*cell)
-	h.trash = newBin()
+	h.trash = newAllocator(h.policy)
 	h.cache = newMem()
 	if lastpage, err = h.load(compactheader); err == nil {
 		h.open = true
@@ -92,6 +157,10 @@ func (h *header) Close() error {
 		h.file = nil
 	}
 	h.keys = nil
+	h.live = nil
+	h.used = nil
+	h.fenced = nil
+	h.pending = nil
 	h.dirty = nil
 	h.trash = nil
 	h.cache = nil
@@ -102,39 +171,217 @@ func (h *header) Close() error {
 	return nil
 }
 
-// load loads the cells from the header file.
+// load loads the cells from the checkpoint file, if it exists, then from
+// the header file.
 func (h *header) load(compactheader bool) (lastpage int64, err error) {
+	// read checkpoint.
+	exists, err := FileExists(h.checkpoint)
+	if err != nil {
+		return 0, ErrFlatFile.Errorf("checkpoint stat failed: %w", err)
+	}
+	if exists {
+		file, err := os.Open(h.checkpoint)
+		if err != nil {
+			return 0, ErrFlatFile.Errorf("checkpoint open failed: %w", err)
+		}
+		tornat, version, err := h.read(file)
+		file.Close()
+		if err == nil && tornat >= 0 {
+			err = ErrFlatFile.Errorf("record at offset %d: incomplete: %w", tornat, ErrCorrupted)
+		}
+		if err == nil {
+			err = checkVersion(version)
+		}
+		if err != nil {
+			return 0, ErrFlatFile.Errorf("checkpoint read failed: %w", err)
+		}
+	}
 	// read header.
-	buf := make([]byte, 4)
-	if _, err := h.file.Read(buf); err != nil {
+	tornat, version, err := h.read(h.file)
+	if err == nil {
+		err = checkVersion(version)
+	}
+	if err != nil {
 		return 0, ErrFlatFile.Errorf("header read failed: %w", err)
 	}
-	for i, v := range buf {
-		if hdr[i] != v {
-			return 0, ErrFlatFile.Errorf("invalid header")
+	// truncate torn last record.
+	if tornat >= 0 && !h.readonly {
+		if err = h.file.Truncate(tornat); err != nil {
+			return 0, ErrFlatFile.Errorf("header truncate failed: %w", err)
+		}
+	}
+	// map keys. If a relocated cell's previous copy was not marked as
+	// deleted both are used under the same key and the newer one wins.
+	h.cells.Walk(func(c *cell) bool {
+		if c.CellState == StateNormal || c.CellState == StateReused {
+			if prev, ok := h.keys[c.key]; !ok || prev.CellID < c.CellID {
+				h.keys[c.key] = c
+			}
+		}
+		return true
+	})
+	// update deleted cells.
+	maxpage := int64(-1)
+	h.cells.Walk(func(c *cell) bool {
+		switch c.CellState {
+		case StateReclaimed:
+			h.cells.Destroy(c)
+			return true
+		case StateDeleted:
+			h.trash.Trash(c)
+		default:
+			if h.keys[c.key] != c {
+				c.key = ""
+				c.clearSum()
+				c.CellState = StateDeleted
+				h.trash.Trash(c)
+				break
+			}
+			h.live[c.PageIndex]++
+			h.used[c.PageIndex] += c.Allocated
+			h.lastKey = c.key
+		}
+		if c.PageIndex > maxpage {
+			maxpage = c.PageIndex
+		}
+		return true
+	})
+	// rewrite header file.
+	if compactheader && h.interval > 0 {
+		if err = h.Checkpoint(); err != nil {
+			return 0, err
+		}
+	} else if compactheader {
+		if err = h.truncate(); err != nil {
+			return 0, err
+		}
+		w := bufio.NewWriter(h.file)
+		if err := h.save(w); err != nil {
+			return 0, err
+		}
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+		if err := os.Remove(h.checkpoint); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	if h.end, err = h.file.Seek(0, os.SEEK_END); err != nil {
+		return 0, err
+	}
+	if tornat >= 0 && h.readonly {
+		h.end = tornat
+	}
+	return maxpage, err
+}
+
+// read reads the signature then cells from file into pot. If the last
+// record in file is incomplete, returns its offset as tornat, otherwise
+// tornat is -1. Returns format version of the file or an error. Files of
+// format version newer than FormatVersion are not read past the version.
+func (h *header) read(file *os.File) (tornat int64, version int, err error) {
+	tornat = -1
+	fi, err := file.Stat()
+	if err != nil {
+		return
+	}
+	if _, err = file.Seek(0, os.SEEK_SET); err != nil {
+		return
+	}
+	// read signature.
+	buf := make([]byte, len(hdr))
+	if _, err = io.ReadFull(file, buf); err != nil {
+		return -1, 0, ErrFlatFile.Errorf("signature read failed: %w", err)
+	}
+	switch {
+	case bytes.Equal(buf, hdr):
+	case bytes.Equal(buf, hdrLegacy):
+		return -1, 0, h.readLegacy(newFullReader(file))
+	default:
+		return -1, 0, ErrFlatFile.Errorf("invalid header: %w", ErrCorrupted)
+	}
+	// Framed files without a version record are version 1.
+	version = 1
+	// read records.
+	rr := newRecordReader(file, int64(len(hdr)), fi.Size())
+	for {
+		off := rr.Offset()
+		typ, payload, err := rr.Next()
+		if errors.Is(err, io.EOF) {
+			return -1, version, nil
+		}
+		if errors.Is(err, errTornRecord) {
+			return off, version, nil
+		}
+		if err != nil {
+			return -1, version, err
+		}
+		switch typ {
+		case recordVersion:
+			if off != int64(len(hdr)) || len(payload) != 2 {
+				return -1, version, ErrFlatFile.Errorf(
+					"record at offset %d: invalid version record: %w", off, ErrCorrupted)
+			}
+			version = int(binary.LittleEndian.Uint16(payload))
+			if version > FormatVersion {
+				return -1, version, nil
+			}
+		case recordCell:
+			cell := &cell{}
+			if err = cell.read(payload, version); err != nil {
+				return -1, version, ErrFlatFile.Errorf(
+					"record at offset %d: %v: %w", off, err, ErrCorrupted)
+			}
+			h.cells.Mask(cell)
+		default:
+			return -1, version, ErrFlatFile.Errorf(
+				"record at offset %d: unknown type %d: %w", off, typ, ErrCorrupted)
 		}
 	}
+}
+
+// writeSignature writes the header signature and format version record
+// to w.
+func writeSignature(w io.Writer) error {
+	return writeVersioned(w, hdr[0:])
+}
+
+// writeVersioned writes signature sig and format version record to w.
+func writeVersioned(w io.Writer, sig []byte) error {
+	if _, err := w.Write(sig); err != nil {
+		return err
+	}
+	var payload [2]byte
+	binary.LittleEndian.PutUint16(payload[:], FormatVersion)
+	return writeRecord(w, recordVersion, payload[:])
+}
+
+// readLegacy reads cells with unframed records from r into pot.
+func (h *header) readLegacy(r io.Reader) (err error) {
 	// temp vars.
 	cbuf := make([]byte, 64)
 	ckey := ""
-	csize := 0
+	csize := int64(0)
 	// read till EOF.
 	for err == nil {
 		cell := &cell{}
 		// key.
-		if err = binaryex.ReadString(h.file, &ckey); err != nil {
+		if err = binaryex.ReadString(r, &ckey); err != nil {
 			break
 		}
 		cell.key = ckey
 		// size.
-		if err = binaryex.ReadNumber(h.file, &csize); err != nil {
+		if err = binaryex.ReadNumber(r, &csize); err != nil {
 			break
 		}
+		if csize < 0 || csize > int64(len(cbuf)) {
+			return ErrFlatFile.Errorf("invalid cell size %d: %w", csize, ErrCorrupted)
+		}
 		// cell.
-		if _, err = io.ReadFull(h.file, cbuf[:csize]); err != nil {
+		if _, err = io.ReadFull(r, cbuf[:csize]); err != nil {
 			break
 		}
-		if err = cell.UnmarshalBinary(cbuf); err != nil {
+		if err = cell.unmarshalLegacy(cbuf[:csize]); err != nil {
 			break
 		}
 		// put cell to pot.
@@ -142,45 +389,15 @@ func (h *header) load(compactheader bool) (lastpage int64, err error) {
 	}
 	// check err
 	if !errors.Is(err, io.EOF) {
-		return 0, err
-	}
-	err = nil
-	// update deleted cells.
-	maxpage := int64(0)
-	h.cells.Walk(func(c *cell) bool {
-		if c.CellState == StateDeleted {
-			h.trash.Trash(c)
-		} else {
-			h.keys[c.key] = c
-			h.lastKey = c.key
-		}
-		if c.PageIndex > maxpage {
-			maxpage = c.PageIndex
-		}
-		return true
-	})
-	// rewrite header file.
-	if compactheader {
-		if err = h.file.Truncate(0); err != nil {
-			return 0, err
-		}
-		if _, err := h.file.Seek(0, os.SEEK_SET); err != nil {
-			return 0, err
-		}
-		if _, err := h.file.Write(hdr[0:]); err != nil {
-			return 0, err
-		}
-		if err := h.save(); err != nil {
-			return 0, err
-		}
+		return err
 	}
-	return maxpage, err
+	return nil
 }
 
-// save saves cells to header.
-func (h *header) save() (err error) {
+// save saves cells to w.
+func (h *header) save(w io.Writer) (err error) {
 	h.cells.Walk(func(c *cell) bool {
-		if err = c.write(h.file, c.key); err != nil {
+		if err = c.write(w, c.key); err != nil {
 			return false
 		}
 		return true
@@ -188,6 +405,89 @@ func (h *header) save() (err error) {
 	return
 }
 
+// truncate truncates header file to signature.
+func (h *header) truncate() error {
+	if err := h.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := h.file.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	if err := writeSignature(h.file); err != nil {
+		return err
+	}
+	h.records = 0
+	return nil
+}
+
+// rewrite atomically replaces the header file with all cells in pot and
+// removes the checkpoint. Header must not be open.
+func (h *header) rewrite() (err error) {
+	buf := bytes.NewBuffer(nil)
+	w := bufio.NewWriter(buf)
+	if err = writeSignature(w); err != nil {
+		return ErrFlatFile.Errorf("header write error: %w", err)
+	}
+	if err = h.save(w); err != nil {
+		return ErrFlatFile.Errorf("header write error: %w", err)
+	}
+	if err = w.Flush(); err != nil {
+		return ErrFlatFile.Errorf("header write error: %w", err)
+	}
+	if err = replaceFile(h.filename, buf.Bytes()); err != nil {
+		return err
+	}
+	if err = os.Remove(h.checkpoint); err != nil && !os.IsNotExist(err) {
+		return ErrFlatFile.Errorf("checkpoint remove error: %w", err)
+	}
+	return nil
+}
+
+// Checkpoint writes all cells to a new checkpoint file which atomically
+// replaces the existing one, then truncates the header file. On load,
+// checkpoint is read before the header file. Dirty cells are written to
+// the header file and synced first so that a header file left untruncated
+// by a crash holds no cell states older than those in the checkpoint.
+func (h *header) Checkpoint() (err error) {
+	if !h.readonly {
+		if err = h.writeDirty(); err != nil {
+			return err
+		}
+		if err = h.file.Sync(); err != nil {
+			return ErrFlatFile.Errorf("header sync error: %w", err)
+		}
+	}
+	tmpname := h.checkpoint + ".tmp"
+	file, err := os.OpenFile(tmpname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return ErrFlatFile.Errorf("checkpoint create error: %w", err)
+	}
+	w := bufio.NewWriter(file)
+	if err = writeSignature(w); err == nil {
+		if err = h.save(w); err == nil {
+			if err = w.Flush(); err == nil {
+				err = file.Sync()
+			}
+		}
+	}
+	if errc := file.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return ErrFlatFile.Errorf("checkpoint write error: %w", err)
+	}
+	if err = os.Rename(tmpname, h.checkpoint); err != nil {
+		os.Remove(tmpname)
+		return ErrFlatFile.Errorf("checkpoint rename error: %w", err)
+	}
+	syncDir(filepath.Dir(h.checkpoint))
+	if err = h.truncate(); err != nil {
+		return ErrFlatFile.Errorf("checkpoint header truncate error: %w", err)
+	}
+	return nil
+}
+
 // Select is the main cell allocation function. It either returns an
 // existing, deleted cell whose Allocated satisfies size requirement
 // if reuse is specified, or a new empty cell if none such found or
@@ -196,10 +496,7 @@ func (h *header) Select(reuse bool, size int64) (c *cell) {
 
 	if reuse {
 		c = h.trash.Recycle(size)
-		if c.Allocated >= size {
-			if c.CellState != StateDeleted {
-				panic("BzZzz...")
-			}
+		if c.CellState == StateDeleted {
 			c.CellState = StateReused
 			c.Used = size
 			return
@@ -212,27 +509,117 @@ func (h *header) Select(reuse bool, size int64) (c *cell) {
 	return
 }
 
+// Split splits off the unused space of a reused cell c into a new deleted
+// cell if unused space is at least minsize and returns it. Returned cell
+// is not yet trashed. If c is not split or minsize <= 0, returns nil.
+func (h *header) Split(c *cell, minsize int64) *cell {
+	if minsize <= 0 || c.CellState != StateReused {
+		return nil
+	}
+	if c.Allocated-c.Used < minsize {
+		return nil
+	}
+	return h.cells.Split(c, c.Used)
+}
+
+// Unsplit merges frag created by Split back into c and destroys it.
+func (h *header) Unsplit(c, frag *cell) {
+	c.Allocated += frag.Allocated
+	h.cells.Destroy(frag)
+}
+
 // Use marks c as used under c.key.
 func (h *header) Use(c *cell) {
 	h.keys[string(c.key)] = c
+	h.live[c.PageIndex]++
+	h.used[c.PageIndex] += c.Allocated
 	h.lastKey = c.key
 }
 
+// Release unmarks c as used under c.key and returns the number of cells
+// still used on c's page.
+func (h *header) Release(c *cell) int64 {
+	delete(h.keys, c.key)
+	h.live[c.PageIndex]--
+	h.used[c.PageIndex] -= c.Allocated
+	n := h.live[c.PageIndex]
+	if n <= 0 {
+		delete(h.live, c.PageIndex)
+		delete(h.used, c.PageIndex)
+	}
+	return n
+}
+
+// Used returns the allocated size of used cells on page with index pageidx.
+func (h *header) Used(pageidx int64) int64 {
+	return h.used[pageidx]
+}
+
+// PageKeys returns keys of used cells on page with index pageidx.
+func (h *header) PageKeys(pageidx int64) (result [][]byte) {
+	for key, c := range h.keys {
+		if c.PageIndex == pageidx {
+			result = append(result, []byte(key))
+		}
+	}
+	return
+}
+
+// Reclaim voids all deleted cells on page with specified index by marking
+// them as reclaimed and removing them from the header. Returns an error if
+// page holds used cells or if updating the header fails.
+func (h *header) Reclaim(pageidx int64, immediate bool) (err error) {
+	if h.live[pageidx] > 0 {
+		return ErrFlatFile.Errorf("page %d reclaim error: page in use", pageidx)
+	}
+	var cells []*cell
+	h.cells.Walk(func(c *cell) bool {
+		if c.PageIndex == pageidx {
+			cells = append(cells, c)
+		}
+		return true
+	})
+	for _, c := range cells {
+		h.trash.Restore(c)
+		c.CellState = StateReclaimed
+		if err = h.Update(c, immediate); err != nil {
+			return
+		}
+		h.cells.Destroy(c)
+	}
+	if !immediate || h.deferred {
+		return h.Flush()
+	}
+	return
+}
+
 // Update updates the cell in the header.
 func (h *header) Update(c *cell, immediate bool) error {
-	if immediate {
+	if immediate && !h.deferred && !h.readonly {
 		if _, err := h.file.Seek(0, os.SEEK_END); err != nil {
 			return ErrFlatFile.Errorf("header seek error: %w", err)
 		}
 		if err := c.write(h.file, c.key); err != nil {
 			return err
 		}
+		h.records++
+		h.checkpointIfDue()
 	} else {
 		h.Endirty(c)
 	}
 	return nil
 }
 
+// checkpointIfDue checkpoints the header if the number of records written
+// since last checkpoint reached checkpoint interval. A failed checkpoint
+// leaves the header file intact and is retried on next record.
+func (h *header) checkpointIfDue() {
+	if h.interval <= 0 || h.records < h.interval {
+		return
+	}
+	h.Checkpoint()
+}
+
 // Destroy destroys a cell removing it from the bin.
 func (h *header) Destroy(c *cell) {
 	h.cells.Destroy(c)
@@ -251,23 +638,90 @@ func (h *header) UnCache(c *cell) {
 	h.cache.Remove(c)
 }
 
-// Trash marks c as deleted.
+// Trash marks c as deleted. Cells on fenced pages are not trashed. If
+// updates are deferred, c is trashed once committed, see Committed.
 func (h *header) Trash(c *cell) {
+	if h.deferred {
+		h.pending[c.CellID] = c
+		return
+	}
+	if h.fenced[c.PageIndex] {
+		return
+	}
 	h.trash.Trash(c)
 }
 
+// Committed trashes cells deleted while updates are deferred. It must be
+// called once their records are synced to the header file.
+func (h *header) Committed() {
+	for id, c := range h.pending {
+		delete(h.pending, id)
+		if h.cells.cells[id] != c || c.CellState != StateDeleted ||
+			h.fenced[c.PageIndex] {
+			continue
+		}
+		h.trash.Trash(c)
+	}
+}
+
+// Fence removes deleted cells on page with index pageidx from trash and
+// keeps further deleted cells on that page out of trash until Unfence.
+func (h *header) Fence(pageidx int64) {
+	h.fenced[pageidx] = true
+	h.cells.Walk(func(c *cell) bool {
+		if c.PageIndex == pageidx && c.CellState == StateDeleted {
+			h.trash.Restore(c)
+		}
+		return true
+	})
+}
+
+// Unfence returns deleted cells on page with index pageidx to trash.
+func (h *header) Unfence(pageidx int64) {
+	if !h.fenced[pageidx] {
+		return
+	}
+	delete(h.fenced, pageidx)
+	h.cells.Walk(func(c *cell) bool {
+		if c.PageIndex == pageidx && c.CellState == StateDeleted &&
+			h.pending[c.CellID] == nil {
+			h.trash.Trash(c)
+		}
+		return true
+	})
+}
+
 // Restore removes the cell from the bin.
 func (h *header) Restore(c *cell) {
 	h.trash.Restore(c)
 }
 
-// Endirty marks a cell under specified key as dirty.
+// Endirty marks a cell under specified key as dirty and signals due if
+// dirty cells reached threshold.
 func (h *header) Endirty(c *cell) {
 	h.dirty[c.CellID] = c
+	if h.due != nil && h.threshold > 0 && len(h.dirty) >= h.threshold {
+		select {
+		case h.due <- struct{}{}:
+		default:
+		}
+	}
 }
 
 // Flush saves any dirty cells to header file.
 func (h *header) Flush() (err error) {
+	if len(h.dirty) == 0 || h.readonly {
+		return
+	}
+	if err = h.writeDirty(); err != nil {
+		return
+	}
+	h.checkpointIfDue()
+	return
+}
+
+// writeDirty appends dirty cells to header file and clears them.
+func (h *header) writeDirty() (err error) {
 	if len(h.dirty) == 0 {
 		return
 	}
@@ -278,11 +732,20 @@ func (h *header) Flush() (err error) {
 		if err = cval.write(h.file, cval.key); err != nil {
 			return ErrFlatFile.Errorf("header write error: %w", err)
 		}
+		h.records++
 	}
-	h.dirty = nil
+	h.dirty = make(map[CellID]*cell)
 	return
 }
 
+// Sync commits the header file to stable storage.
+func (h *header) Sync() error {
+	if err := h.file.Sync(); err != nil {
+		return ErrFlatFile.Errorf("header sync error: %w", err)
+	}
+	return nil
+}
+
 // IsKeyUsed checks if a cell under specified key exists.
 func (h *header) IsKeyUsed(key []byte) (used bool) {
 	_, used = h.keys[string(key)]
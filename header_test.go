@@ -1,8 +1,14 @@
 package flatfile
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
+
+	"github.com/vedranvuk/binaryex"
 )
 
 func TestHeader(t *testing.T) {
@@ -25,3 +31,263 @@ func TestHeader(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestHeaderCheckpoint(t *testing.T) {
+
+	testdir := "test/checkpoint"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.CompactHeader = false
+	options.CheckpointRecords = 10
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make(map[string]string)
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("key%d", i)
+		data[key] = key
+		if err := ff.Put([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("key%d", i)
+		data[key] = "modified"
+		if err := ff.Modify([]byte(key), []byte("modified")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if exists, _ := FileExists(ff.header.checkpoint); !exists {
+		t.Fatal("checkpoint failed, no checkpoint file")
+	}
+	if ff.header.records >= options.CheckpointRecords {
+		t.Fatalf("checkpoint failed, %d records in header", ff.header.records)
+	}
+
+	for loop := 0; loop < 2; loop++ {
+		if err := ff.Reopen(); err != nil {
+			t.Fatal(err)
+		}
+		for key, val := range data {
+			blob, err := ff.Get([]byte(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(blob) != val {
+				t.Fatalf("checkpoint failed, want '%s', got '%s'", val, string(blob))
+			}
+		}
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHeaderCheckpointCrash(t *testing.T) {
+
+	testdir := "test/checkpointcrash"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.CompactHeader = false
+	options.PersistentHeader = false
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if err := ff.Put(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ff.header.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Delete([]byte("key0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash after the checkpoint is renamed into place but before the
+	// header file is truncated. Failing rename leaves the header file as
+	// it was before truncation, then the checkpoint is written in place.
+	if err := os.MkdirAll(ff.header.checkpoint+"/x", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.header.Checkpoint(); err == nil {
+		t.Fatal("checkpoint did not fail")
+	}
+	if err := os.RemoveAll(ff.header.checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := writeSignature(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.header.save(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(ff.header.checkpoint, buf.Bytes(), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	ff.header.file.Close()
+	ff.stream.Close()
+	ff.unlock()
+
+	ff, err = Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	for i := 0; i < 10; i++ {
+		_, err := ff.Get([]byte(fmt.Sprintf("key%d", i)))
+		if i == 0 && !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("key%d: want ErrKeyNotFound, got %v", i, err)
+		}
+		if i > 0 && err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHeaderRecords(t *testing.T) {
+
+	const (
+		headertest = "test/headerrecords"
+	)
+	os.RemoveAll(headertest)
+	defer os.RemoveAll(headertest)
+
+	writecells := func(n int) {
+		h := newHeader(headertest)
+		if _, err := h.Open(false, false); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			c := h.Select(false, 8)
+			c.key = fmt.Sprintf("key%d", i)
+			if err := h.Update(c, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := h.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opencells := func() (*header, error) {
+		h := newHeader(headertest)
+		if _, err := h.Open(false, false); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+
+	// Torn last record is truncated.
+	writecells(3)
+	fi, err := os.Stat(headertest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(headertest, os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0x20, 0x00, 0x00, 0x00, byte(recordCell), 0x01})
+	file.Close()
+	h, err := opencells()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.cells.cells) != 3 {
+		t.Fatalf("torn record failed, want 3 cells, got %d", len(h.cells.cells))
+	}
+	h.Close()
+	if nfi, _ := os.Stat(headertest); nfi.Size() != fi.Size() {
+		t.Fatalf("torn record failed, want size %d, got %d", fi.Size(), nfi.Size())
+	}
+
+	// Zeros appended by a crash during append are truncated.
+	file, err = os.OpenFile(headertest, os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(make([]byte, 4096))
+	file.Close()
+	h, err = opencells()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.cells.cells) != 3 {
+		t.Fatalf("zero tail failed, want 3 cells, got %d", len(h.cells.cells))
+	}
+	h.Close()
+	if nfi, _ := os.Stat(headertest); nfi.Size() != fi.Size() {
+		t.Fatalf("zero tail failed, want size %d, got %d", fi.Size(), nfi.Size())
+	}
+
+	// Zero size followed by data is reported.
+	file, err = os.OpenFile(headertest, os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(append(make([]byte, 16), 0x01))
+	file.Close()
+	if _, err := opencells(); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("zero size failed, want ErrCorrupted, got %v", err)
+	}
+	if err := os.Truncate(headertest, fi.Size()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupted record in the middle is reported.
+	file, err = os.OpenFile(headertest, os.O_RDWR, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{0xFF}, int64(len(hdr))+6)
+	file.Close()
+	if _, err := opencells(); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("corrupted record failed, want ErrCorrupted, got %v", err)
+	}
+
+	// Legacy header is rejected, then migrated.
+	os.RemoveAll(headertest)
+	buf := bytes.NewBuffer(nil)
+	buf.Write(hdrLegacy)
+	for i := 0; i < 3; i++ {
+		c := &cell{CellID: CellID(i + 1), Offset: int64(i * 8), Allocated: 8, Used: 8}
+		data := marshalLegacyCell(t, c)
+		binaryex.WriteString(buf, fmt.Sprintf("key%d", i))
+		binaryex.WriteNumber(buf, len(data))
+		buf.Write(data)
+	}
+	if err := ioutil.WriteFile(headertest, buf.Bytes(), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = opencells(); !errors.Is(err, ErrFormatVersion) {
+		t.Fatalf("legacy header failed, want ErrFormatVersion, got %v", err)
+	}
+	if migrated, err := migrateHeader(headertest); err != nil || !migrated {
+		t.Fatalf("legacy header migrate failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(headertest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, hdr) {
+		t.Fatal("legacy header failed, header not migrated")
+	}
+	h, err = opencells()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.keys) != 3 {
+		t.Fatalf("legacy header failed, want 3 keys, got %d", len(h.keys))
+	}
+	h.Close()
+}
@@ -0,0 +1,487 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The journal is a write-ahead log of Put, Modify and Delete operations
+// kept in a .journal file if UseJournal option is enabled. It consists of
+// the journal signature, a version record and framed records, see
+// record.go.
+//
+// Before an operation changes the stream or the header, an op record that
+// holds the key, the new value (redo) and the old value, if any, (undo) is
+// appended to the journal. If the operation fails, an abort record is
+// appended after the undo is applied. The journal is reset once the header
+// holds all journaled operations on disk: on Close, after replay on Open,
+// and when the journal grows past journalResetSize if the header is
+// persistent.
+//
+// Replay on Open applies every op record not followed by its abort record,
+// in order. Put and Modify ops set the key to the new value, Delete ops
+// remove the key. Replay is idempotent: ops already applied are applied
+// again with the same result. If an op can not be applied, its undo is
+// applied: the key is set to the old value or removed if there was none.
+// Open fails if the undo can not be applied either.
+//
+// Recovery guarantees:
+//
+//	SyncWrites PersistentHeader Guarantee
+//	true       true             Operations that returned are durable, even
+//	                            on power loss. An operation in progress is
+//	                            completed or rolled back.
+//	true       false            Same, operations since the last header flush
+//	                            are replayed from the journal.
+//	false      true             Same as above on process crash. On power
+//	                            loss operations not yet written to disk by
+//	                            the OS are lost and may be partially applied.
+//	false      false            Same as above.
+//
+// GroupCommit gives the guarantees of SyncWrites.
+
+// journalOp defines a journaled operation.
+type journalOp uint8
+
+const (
+	// journalPut is a Put operation.
+	journalPut journalOp = iota + 1
+	// journalModify is a Modify operation.
+	journalModify
+	// journalDelete is a Delete operation.
+	journalDelete
+)
+
+// jrnsig is the .journal signature.
+var jrnsig = []byte{0xF1, 0x47, 0x1A, 0x01}
+
+// journalResetSize is the size past which the journal is reset after an
+// operation if the header is persistent.
+const journalResetSize = 4 << 20
+
+// journalEntry is a journaled operation.
+type journalEntry struct {
+	// seq is the operation sequence number.
+	seq uint64
+	// event is the event sequence number the operation is assigned if it
+	// succeeds, see Event.
+	event uint64
+	// op is the operation.
+	op journalOp
+	// key is the operation key.
+	key []byte
+	// val is the new value of Put and Modify operations.
+	val []byte
+	// old is the value before the operation, if hasOld.
+	old []byte
+	// hasOld specifies if the key existed before the operation.
+	hasOld bool
+	// aborted specifies if the operation was aborted.
+	aborted bool
+}
+
+// journalEntrySize is the size of an op record payload without the key
+// and values.
+const journalEntrySize = 8 + 8 + 1 + 1 + 4 + 8 + 8
+
+// marshal marshals the entry to an op record payload laid out as, all
+// integers little endian: seq uint64, event uint64, op uint8, hasOld
+// uint8, key length uint32, val length uint64, old length uint64, key,
+// val, old.
+func (je *journalEntry) marshal() []byte {
+	data := make([]byte, journalEntrySize,
+		journalEntrySize+len(je.key)+len(je.val)+len(je.old))
+	binary.LittleEndian.PutUint64(data[0:8], je.seq)
+	binary.LittleEndian.PutUint64(data[8:16], je.event)
+	data[16] = byte(je.op)
+	if je.hasOld {
+		data[17] = 1
+	}
+	binary.LittleEndian.PutUint32(data[18:22], uint32(len(je.key)))
+	binary.LittleEndian.PutUint64(data[22:30], uint64(len(je.val)))
+	binary.LittleEndian.PutUint64(data[30:38], uint64(len(je.old)))
+	data = append(data, je.key...)
+	data = append(data, je.val...)
+	return append(data, je.old...)
+}
+
+// unmarshal unmarshals the entry from an op record payload.
+func (je *journalEntry) unmarshal(data []byte) error {
+	const size = journalEntrySize
+	if len(data) < size {
+		return ErrFlatFile.Errorf("invalid journal op size: %w", ErrCorrupted)
+	}
+	je.seq = binary.LittleEndian.Uint64(data[0:8])
+	je.event = binary.LittleEndian.Uint64(data[8:16])
+	je.op = journalOp(data[16])
+	je.hasOld = data[17] != 0
+	keylen := uint64(binary.LittleEndian.Uint32(data[18:22]))
+	vallen := binary.LittleEndian.Uint64(data[22:30])
+	oldlen := binary.LittleEndian.Uint64(data[30:38])
+	rest := uint64(len(data) - size)
+	if keylen > rest || vallen > rest || oldlen > rest || keylen+vallen+oldlen != rest {
+		return ErrFlatFile.Errorf("invalid journal op lengths: %w", ErrCorrupted)
+	}
+	data = data[size:]
+	je.key = data[:keylen]
+	je.val = data[keylen : keylen+vallen]
+	je.old = data[keylen+vallen:]
+	if je.op < journalPut || je.op > journalDelete {
+		return ErrFlatFile.Errorf("invalid journal op %d: %w", je.op, ErrCorrupted)
+	}
+	return nil
+}
+
+// journal is the write-ahead journal.
+type journal struct {
+	// filename is the journal filename.
+	filename string
+	// file is the journal file.
+	file *os.File
+	// seq is the last operation sequence number.
+	seq uint64
+	// size is the size of the journal file.
+	size int64
+}
+
+// openJournal opens or creates the journal file filename and returns it
+// with the entries it holds, in order. A torn last record is truncated.
+func openJournal(filename string, sync bool) (j *journal, entries []*journalEntry, err error) {
+	opt := os.O_CREATE | os.O_RDWR
+	if sync {
+		opt = opt | os.O_SYNC
+	}
+	file, err := os.OpenFile(filename, opt, os.ModePerm)
+	if err != nil {
+		return nil, nil, ErrFlatFile.Errorf("journal open error: %w", err)
+	}
+	j = &journal{filename: filename, file: file}
+	if entries, err = j.read(); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		if entry.seq > j.seq {
+			j.seq = entry.seq
+		}
+	}
+	return j, entries, nil
+}
+
+// read reads entries from the journal file. It initializes an empty file
+// and truncates a torn last record.
+func (j *journal) read() (entries []*journalEntry, err error) {
+	fi, err := j.file.Stat()
+	if err != nil {
+		return nil, ErrFlatFile.Errorf("journal stat error: %w", err)
+	}
+	if fi.Size() == 0 {
+		return nil, j.Reset()
+	}
+	buf := make([]byte, len(jrnsig))
+	if _, err = j.file.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, jrnsig) {
+		return nil, ErrFlatFile.Errorf("invalid journal signature: %w", ErrCorrupted)
+	}
+	if _, err = j.file.Seek(int64(len(jrnsig)), os.SEEK_SET); err != nil {
+		return nil, ErrFlatFile.Errorf("journal seek error: %w", err)
+	}
+	ops := make(map[uint64]*journalEntry)
+	rr := newRecordReader(j.file, int64(len(jrnsig)), fi.Size())
+	for {
+		off := rr.Offset()
+		typ, payload, err := rr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, errTornRecord) {
+			if err = j.file.Truncate(off); err != nil {
+				return nil, ErrFlatFile.Errorf("journal truncate error: %w", err)
+			}
+			break
+		}
+		if err != nil {
+			return nil, ErrFlatFile.Errorf("journal read error: %w", err)
+		}
+		switch typ {
+		case recordVersion:
+			if len(payload) != 2 {
+				return nil, ErrFlatFile.Errorf("invalid journal version: %w", ErrCorrupted)
+			}
+			if err = checkVersion(int(binary.LittleEndian.Uint16(payload))); err != nil {
+				return nil, err
+			}
+		case recordOp:
+			entry := &journalEntry{}
+			if err = entry.unmarshal(payload); err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+			ops[entry.seq] = entry
+		case recordAbort:
+			if len(payload) != 8 {
+				return nil, ErrFlatFile.Errorf("invalid journal abort: %w", ErrCorrupted)
+			}
+			if entry, ok := ops[binary.LittleEndian.Uint64(payload)]; ok {
+				entry.aborted = true
+			}
+		default:
+			return nil, ErrFlatFile.Errorf(
+				"journal record at offset %d: unknown type %d: %w", off, typ, ErrCorrupted)
+		}
+	}
+	if j.size, err = j.file.Seek(0, os.SEEK_END); err != nil {
+		return nil, ErrFlatFile.Errorf("journal seek error: %w", err)
+	}
+	return
+}
+
+// Begin appends an op record for operation op on key with new value val
+// and old value old, if hasOld, to be assigned event sequence number
+// event. Returns the operation sequence number.
+func (j *journal) Begin(event uint64, op journalOp, key, val, old []byte, hasOld bool) (seq uint64, err error) {
+	j.seq++
+	entry := &journalEntry{
+		seq:    j.seq,
+		event:  event,
+		op:     op,
+		key:    key,
+		val:    val,
+		old:    old,
+		hasOld: hasOld,
+	}
+	if err = j.append(recordOp, entry.marshal()); err != nil {
+		return 0, err
+	}
+	return j.seq, nil
+}
+
+// Abort appends an abort record for operation with sequence number seq.
+func (j *journal) Abort(seq uint64) error {
+	var payload [8]byte
+	binary.LittleEndian.PutUint64(payload[:], seq)
+	return j.append(recordAbort, payload[:])
+}
+
+// append appends a record to the journal file.
+func (j *journal) append(typ recordType, payload []byte) error {
+	buf := bytes.NewBuffer(nil)
+	if err := writeRecord(buf, typ, payload); err != nil {
+		return ErrFlatFile.Errorf("journal write error: %w", err)
+	}
+	if _, err := j.file.WriteAt(buf.Bytes(), j.size); err != nil {
+		return ErrFlatFile.Errorf("journal write error: %w", err)
+	}
+	j.size += int64(buf.Len())
+	return nil
+}
+
+// Reset truncates the journal to signature.
+func (j *journal) Reset() error {
+	if err := j.file.Truncate(0); err != nil {
+		return ErrFlatFile.Errorf("journal truncate error: %w", err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := writeVersioned(buf, jrnsig); err != nil {
+		return ErrFlatFile.Errorf("journal write error: %w", err)
+	}
+	if _, err := j.file.WriteAt(buf.Bytes(), 0); err != nil {
+		return ErrFlatFile.Errorf("journal write error: %w", err)
+	}
+	j.size = int64(buf.Len())
+	return nil
+}
+
+// Sync commits the journal file to stable storage.
+func (j *journal) Sync() error {
+	if err := j.file.Sync(); err != nil {
+		return ErrFlatFile.Errorf("journal sync error: %w", err)
+	}
+	return nil
+}
+
+// Close closes the journal file.
+func (j *journal) Close() error {
+	return j.file.Close()
+}
+
+// journalName returns the journal filename of the FlatFile.
+func (ff *FlatFile) journalName() string {
+	return fmt.Sprintf("%s.%s", filepath.Join(ff.filename, filepath.Base(ff.filename)), JournalExt)
+}
+
+// openJournal opens the journal of the FlatFile, replays operations it holds,
+// flushes the header and resets the journal.
+func (ff *FlatFile) openJournal() error {
+	j, entries, err := openJournal(ff.journalName(), ff.options.SyncWrites)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		if err = ff.replay(entries); err != nil {
+			j.Close()
+			return ErrFlatFile.Errorf("journal replay error: %w", err)
+		}
+		if err = ff.header.Flush(); err != nil {
+			j.Close()
+			return ErrFlatFile.Errorf("journal replay error: %w", err)
+		}
+		if err = j.Reset(); err != nil {
+			j.Close()
+			return err
+		}
+	}
+	ff.journal = j
+	return nil
+}
+
+// removeJournal replays the journal of the FlatFile left by a session that
+// used one, if any, then removes it.
+func (ff *FlatFile) removeJournal() error {
+	exists, err := FileExists(ff.journalName())
+	if err != nil {
+		return ErrFlatFile.Errorf("journal stat error: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+	if err = ff.openJournal(); err != nil {
+		return err
+	}
+	err = ff.journal.Close()
+	ff.journal = nil
+	if err != nil {
+		return ErrFlatFile.Errorf("journal close error: %w", err)
+	}
+	if err = os.Remove(ff.journalName()); err != nil {
+		return ErrFlatFile.Errorf("journal remove error: %w", err)
+	}
+	return nil
+}
+
+// replay replays journal entries.
+func (ff *FlatFile) replay(entries []*journalEntry) error {
+	for _, entry := range entries {
+		if entry.aborted {
+			continue
+		}
+		var err error
+		if entry.op == journalDelete {
+			err = ff.ensure(entry.key, nil, false)
+		} else {
+			err = ff.ensure(entry.key, entry.val, true)
+		}
+		if err == nil {
+			// Log the change unless it was logged before the crash.
+			if ff.changelog != nil && entry.event > ff.changelog.last {
+				if _, err = ff.logChange(entry.op, entry.key); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if errundo := ff.ensure(entry.key, entry.old, entry.hasOld); errundo != nil {
+			return ErrFlatFile.Errorf(
+				"journal op %d replay error: %v, undo error: %w", entry.seq, err, errundo)
+		}
+	}
+	return nil
+}
+
+// ensure sets key to val if exists or removes key otherwise, unless the
+// FlatFile already is in that state.
+func (ff *FlatFile) ensure(key, val []byte, exists bool) error {
+	if _, ok := ff.header.Cell(key); ok {
+		if exists {
+			if cur, err := ff.get(key, false); err == nil && bytes.Equal(cur, val) {
+				return nil
+			}
+		}
+		if err := ff.delete(key); err != nil {
+			return err
+		}
+	}
+	if !exists {
+		return nil
+	}
+	return ff.put(key, val)
+}
+
+// oldValue returns the value of key in cell c to journal as the old value
+// and to restore if a modify fails. A value that fails verification is
+// returned as no old value, so that a damaged key can still be modified or
+// deleted; undo then removes the key.
+func (ff *FlatFile) oldValue(key []byte, c *cell) (old []byte, hasOld bool, err error) {
+	if c.Cached() {
+		return c.cache, true, nil
+	}
+	old, err = ff.get(key, false)
+	if errors.Is(err, ErrChecksumFailed) || errors.Is(err, ErrCorrupted) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, ErrFlatFile.Errorf("failed getting cell blob for journal: %w", err)
+	}
+	return old, true, nil
+}
+
+// journalBegin journals an operation if journal is enabled. Returns the
+// operation sequence number.
+func (ff *FlatFile) journalBegin(op journalOp, key, val, old []byte, hasOld bool) (uint64, error) {
+	if ff.journal == nil {
+		return 0, nil
+	}
+	seq, err := ff.journal.Begin(ff.events+1, op, key, val, old, hasOld)
+	if err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// journalEnd ends a journaled operation with sequence number seq. If the
+// operation failed with err, an abort is journaled. Otherwise journal is
+// reset if it grew past journalResetSize and the header is persistent.
+func (ff *FlatFile) journalEnd(seq uint64, err error) error {
+	if ff.journal == nil {
+		return nil
+	}
+	if err != nil {
+		return ff.journal.Abort(seq)
+	}
+	if ff.options.PersistentHeader && !ff.header.deferred && ff.journal.size > journalResetSize {
+		return ff.journal.Reset()
+	}
+	return nil
+}
+
+// complete completes operation op on key with new value val journaled with
+// sequence number seq. If the operation failed with err, an abort is
+// journaled and err is returned. Otherwise its change is logged and
+// replicated before the journal may be reset, and the journal is not reset
+// if the change could not be logged, so that the change is replayed if it
+// is lost in a crash.
+func (ff *FlatFile) complete(seq uint64, op journalOp, key, val []byte, err error) error {
+	if err != nil {
+		ff.journalEnd(seq, err)
+		return err
+	}
+	event, err := ff.logChange(op, key)
+	if errr := ff.replicate(event, op, key, val); errr != nil && err == nil {
+		err = errr
+	}
+	if event == 0 {
+		return err
+	}
+	if errj := ff.journalEnd(seq, nil); errj != nil && err == nil {
+		err = errj
+	}
+	return err
+}
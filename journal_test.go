@@ -0,0 +1,229 @@
+package flatfile
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalReplay(t *testing.T) {
+
+	testdir := "test/journalreplay"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.UseJournal = true
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := ff.Put([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Journal operations that never reached the FlatFile, twice, second time
+	// after they were already applied.
+	base := filepath.Join(testdir, filepath.Base(testdir))
+	for i := 0; i < 2; i++ {
+		j, entries, err := openJournal(base+"."+JournalExt, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Fatalf("journal not reset, %d entries", len(entries))
+		}
+		if _, err := j.Begin(0, journalModify, []byte("a"), []byte("A"), []byte("a"), true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := j.Begin(0, journalDelete, []byte("b"), nil, []byte("b"), true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := j.Begin(0, journalPut, []byte("c"), []byte("c"), nil, false); err != nil {
+			t.Fatal(err)
+		}
+		seq, err := j.Begin(0, journalPut, []byte("d"), []byte("d"), nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := j.Abort(seq); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		ff, err = Open(testdir, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"a": "A", "c": "c"}
+		if ff.Len() != len(want) {
+			t.Fatalf("replay failed, want %d keys, got %d", len(want), ff.Len())
+		}
+		for key, val := range want {
+			blob, err := ff.Get([]byte(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(blob) != val {
+				t.Fatalf("replay failed, key '%s' want '%s', got '%s'", key, val, blob)
+			}
+		}
+		if err := ff.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestJournalCrash(t *testing.T) {
+
+	testdir := "test/journalcrash"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.UseJournal = true
+	options.PersistentHeader = false
+	options.CRC = true
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		val := bytes.Repeat([]byte{byte(i)}, 100)
+		if err := ff.Put([]byte(key), val); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+	}
+	for i := 0; i < 20; i += 3 {
+		key := fmt.Sprintf("key%d", i)
+		if err := ff.Delete([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, key)
+	}
+	for i := 1; i < 20; i += 3 {
+		key := fmt.Sprintf("key%d", i)
+		val := bytes.Repeat([]byte{byte(i + 100)}, 100)
+		if err := ff.Modify([]byte(key), val); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+	}
+
+	// Crash without flushing the header.
+	ff.header.file.Close()
+	ff.stream.Close()
+	ff.journal.Close()
+	ff.unlock()
+
+	ff, err = Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	if ff.Len() != len(want) {
+		t.Fatalf("recovery failed, want %d keys, got %d", len(want), ff.Len())
+	}
+	for key, val := range want {
+		blob, err := ff.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(blob, val) {
+			t.Fatalf("recovery failed, key '%s' value mismatch", key)
+		}
+	}
+}
+
+func TestModifyDeleteDamaged(t *testing.T) {
+
+	testdir := "test/modifydamaged"
+	for _, journal := range []bool{false, true} {
+		os.RemoveAll(testdir)
+		options := NewOptions()
+		options.UseJournal = journal
+		options.MaxCacheMemory = 0
+		ff, err := Open(testdir, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"a", "b"} {
+			if err := ff.Put([]byte(key), []byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			cell, _ := ff.header.Cell([]byte(key))
+			if _, err := ff.stream.Page(cell).file.WriteAt([]byte{0xFF}, cell.Offset); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ff.Modify([]byte("a"), []byte("A")); err != nil {
+			t.Fatalf("journal %t: modify damaged key: %v", journal, err)
+		}
+		if blob, err := ff.Get([]byte("a")); err != nil || string(blob) != "A" {
+			t.Fatalf("journal %t: want 'A', got '%s' (%v)", journal, blob, err)
+		}
+		if err := ff.Delete([]byte("b")); err != nil {
+			t.Fatalf("journal %t: delete damaged key: %v", journal, err)
+		}
+		if err := ff.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.RemoveAll(testdir)
+}
+
+func TestJournalDisabled(t *testing.T) {
+
+	testdir := "test/journaldisabled"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.UseJournal = true
+	options.PersistentHeader = false
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := ff.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Crash without flushing the header.
+	ff.header.file.Close()
+	ff.stream.Close()
+	ff.journal.Close()
+	ff.unlock()
+
+	// Journal of the crashed session is replayed and removed.
+	options = NewOptions()
+	options.UseJournal = false
+	ff, err = Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	if ff.journal != nil {
+		t.Fatal("journal opened while disabled")
+	}
+	if exists, _ := FileExists(ff.journalName()); exists {
+		t.Fatal("journal not removed")
+	}
+	if ff.Len() != 5 {
+		t.Fatalf("recovery failed, want 5 keys, got %d", ff.Len())
+	}
+}
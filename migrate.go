@@ -0,0 +1,299 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/vedranvuk/binaryex"
+)
+
+// FormatVersion is the version of the on-disk format of FlatFile files.
+//
+// Format version is stored in .header and .checkpoint files as the first
+// record and in .options file after its signature. Stream pages hold raw
+// blobs addressed by the header and follow the format version of the
+// header.
+//
+// Compatibility policy:
+//
+// Open opens only files of the current FormatVersion. Files of an older
+// version are rejected with an error that wraps ErrFormatVersion and must be
+// upgraded in place with Migrate first. Files of a newer version are always
+// rejected. FormatVersion is increased on every change to the layout of
+// files that older code can not read. Adding a field to Options does not
+// change the format version; missing fields load as defaults and unknown
+// fields are ignored.
+//
+// Versions:
+//
+//	0 - Unframed header records, options stored as a raw struct dump.
+//	1 - Framed and checksummed header records, options stored by name.
+//	2 - Fixed layout, little endian cells, see cell.go.
+//	3 - Cells hold checksum algorithm, presence flag and variable size sum.
+const FormatVersion = 3
+
+// checkVersion returns an error if version is not FormatVersion.
+func checkVersion(version int) error {
+	if version < FormatVersion {
+		return ErrFlatFile.Errorf(
+			"format version %d, want %d, migrate required: %w",
+			version, FormatVersion, ErrFormatVersion)
+	}
+	if version > FormatVersion {
+		return ErrFlatFile.Errorf(
+			"format version %d is newer than supported version %d: %w",
+			version, FormatVersion, ErrFormatVersion)
+	}
+	return nil
+}
+
+// Migrate upgrades the FlatFile in base directory filename to FormatVersion
+// in place. Pending intents of FlatFiles that used them are converted to
+// journal operations replayed on next Open if UseJournal is enabled.
+// FlatFile must not be open, otherwise an error that wraps ErrLocked is
+// returned. Mirrors are separate FlatFiles and must be migrated separately.
+//
+// Returns truth if any file was upgraded or an error if one occurs.
+func Migrate(filename string) (migrated bool, err error) {
+	bn := filepath.Base(filename)
+	if bn == "." || bn == "/" {
+		return false, ErrFlatFile.Errorf("invalid filename: '%s'", filename)
+	}
+	base := filepath.Join(filename, bn)
+	lock, err := lockFile(fmt.Sprintf("%s.%s", base, LockExt), true)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Close()
+	mo, err := migrateOptions(fmt.Sprintf("%s.%s", base, OptionsExt))
+	if err != nil {
+		return false, err
+	}
+	mh, err := migrateHeader(fmt.Sprintf("%s.%s", base, HeaderExt))
+	if err != nil {
+		return false, err
+	}
+	migrated = mo || mh
+	mi, err := migrateIntents(filename, fmt.Sprintf("%s.%s", base, JournalExt))
+	if err != nil {
+		return migrated, err
+	}
+	migrated = migrated || mi
+	return
+}
+
+// intentsDir is the directory of the intents FlatFile that preceded the
+// journal.
+const intentsDir = ".intents"
+
+// migrateIntents converts intents of the FlatFile in base directory filename,
+// if any, to operations in journal file journalfn which restore blobs under
+// intent keys when the FlatFile is opened, then removes the intents.
+func migrateIntents(filename, journalfn string) (migrated bool, err error) {
+	dir := filepath.Join(filename, intentsDir)
+	exists, err := FileExists(dir)
+	if err != nil {
+		return false, ErrFlatFile.Errorf("intents stat error: %w", err)
+	}
+	if !exists {
+		return false, nil
+	}
+	if _, err = Migrate(dir); err != nil {
+		return false, ErrFlatFile.Errorf("intents migrate error: %w", err)
+	}
+	options := NewOptions()
+	options.utility = true
+	intents, err := Open(dir, options)
+	if err != nil {
+		return false, ErrFlatFile.Errorf("intents open error: %w", err)
+	}
+	j, _, err := openJournal(journalfn, true)
+	if err != nil {
+		intents.Close()
+		return false, err
+	}
+	for _, key := range intents.Keys() {
+		var blob []byte
+		if blob, err = intents.Get(key); err != nil {
+			err = ErrFlatFile.Errorf("intent get error: %w", err)
+			break
+		}
+		if _, err = j.Begin(0, journalModify, key, blob, nil, false); err != nil {
+			break
+		}
+	}
+	errj := j.Close()
+	erri := intents.Close()
+	if err != nil {
+		return false, err
+	}
+	if errj != nil || erri != nil {
+		return false, ErrFlatFile.Errorf("intents migrate error: journal: %v, intents: %v", errj, erri)
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		return false, ErrFlatFile.Errorf("intents remove error: %w", err)
+	}
+	return true, nil
+}
+
+// migrateOptions upgrades options file filename if it exists and is not of
+// FormatVersion.
+func migrateOptions(filename string) (migrated bool, err error) {
+	data, err := readFileIfExists(filename)
+	if err != nil || data == nil {
+		return false, err
+	}
+	options := NewOptions()
+	version, err := options.read(bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	if version == FormatVersion {
+		return false, nil
+	}
+	if version > FormatVersion {
+		return false, checkVersion(version)
+	}
+	if version == 0 {
+		legacy := &legacyOptions{}
+		if err = binaryex.Read(bytes.NewReader(data), legacy); err != nil {
+			return false, ErrFlatFile.Errorf("legacy options read error: %w", err)
+		}
+		legacy.apply(options)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err = options.Marshal(buf); err != nil {
+		return false, ErrFlatFile.Errorf("options marshal error: %w", err)
+	}
+	if err = replaceFile(filename, buf.Bytes()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// migrateHeader upgrades header file filename and its checkpoint if they
+// exist and are not of FormatVersion. Upgraded header holds all cells and
+// replaces the checkpoint.
+func migrateHeader(filename string) (migrated bool, err error) {
+	h := newHeader(filename)
+	h.cells = newPot()
+	versions := make([]int, 0, 2)
+	for _, fn := range []string{h.checkpoint, h.filename} {
+		exists, err := FileExists(fn)
+		if err != nil {
+			return false, ErrFlatFile.Errorf("header stat error: %w", err)
+		}
+		if !exists {
+			continue
+		}
+		file, err := os.Open(fn)
+		if err != nil {
+			return false, ErrFlatFile.Errorf("header open error: %w", err)
+		}
+		_, version, err := h.read(file)
+		file.Close()
+		if err != nil {
+			return false, ErrFlatFile.Errorf("header '%s' read error: %w", fn, err)
+		}
+		if version > FormatVersion {
+			return false, checkVersion(version)
+		}
+		versions = append(versions, version)
+	}
+	current := true
+	for _, version := range versions {
+		current = current && version == FormatVersion
+	}
+	if current {
+		return false, nil
+	}
+	if err = h.rewrite(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// readFileIfExists reads file filename or returns nil data if it does not
+// exist.
+func readFileIfExists(filename string) ([]byte, error) {
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, ErrFlatFile.Errorf("file open error: %w", err)
+	}
+	defer file.Close()
+	buf := bytes.NewBuffer(nil)
+	if _, err = buf.ReadFrom(file); err != nil {
+		return nil, ErrFlatFile.Errorf("file read error: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// replaceFile atomically replaces file filename with data by writing it to
+// a temporary file first then renaming it to filename.
+func replaceFile(filename string, data []byte) (err error) {
+	tmpname := filename + ".tmp"
+	file, err := os.OpenFile(tmpname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return ErrFlatFile.Errorf("file create error: %w", err)
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if errc := file.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return ErrFlatFile.Errorf("file write error: %w", err)
+	}
+	if err = os.Rename(tmpname, filename); err != nil {
+		os.Remove(tmpname)
+		return ErrFlatFile.Errorf("file rename error: %w", err)
+	}
+	syncDir(filepath.Dir(filename))
+	return nil
+}
+
+// legacyOptions is the layout of options of format version 0.
+type legacyOptions struct {
+	MirrorDir            string
+	CRC                  bool
+	MaxCacheMemory       int64
+	CachedWrites         bool
+	MaxPageSize          int64
+	PreallocatePages     bool
+	PersistentHeader     bool
+	Immutable            bool
+	SyncWrites           bool
+	ZeroPadDeleted       bool
+	MergeAdjacentDeletes bool
+	CompactHeader        bool
+	UseIntents           bool
+}
+
+// apply applies legacy options to o.
+func (lo *legacyOptions) apply(o *Options) {
+	o.MirrorDir = lo.MirrorDir
+	o.CRC = lo.CRC
+	o.MaxCacheMemory = lo.MaxCacheMemory
+	o.CachedWrites = lo.CachedWrites
+	o.MaxPageSize = lo.MaxPageSize
+	o.PreallocatePages = lo.PreallocatePages
+	o.PersistentHeader = lo.PersistentHeader
+	o.Immutable = lo.Immutable
+	o.SyncWrites = lo.SyncWrites
+	o.ZeroPadDeleted = lo.ZeroPadDeleted
+	o.MergeAdjacentDeletes = lo.MergeAdjacentDeletes
+	o.CompactHeader = lo.CompactHeader
+	o.UseJournal = lo.UseIntents
+}
@@ -0,0 +1,178 @@
+package flatfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vedranvuk/binaryex"
+)
+
+// marshalLegacyCell marshals c as format versions 0 and 1 did.
+func marshalLegacyCell(t *testing.T, c *cell) []byte {
+	lc := &legacyCell{
+		CellID:    c.CellID,
+		CellState: c.CellState,
+		PageIndex: c.PageIndex,
+		Offset:    c.Offset,
+		Allocated: c.Allocated,
+		Used:      c.Used,
+	}
+	if c.Sum != nil {
+		lc.CRC32 = binary.BigEndian.Uint32(c.Sum)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := binaryex.WriteStruct(buf, lc); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// marshalV2Cell marshals c as format version 2 did.
+func marshalV2Cell(c *cell) []byte {
+	data := make([]byte, cellSizeV2)
+	c.marshalGeometry(data)
+	if c.Sum != nil {
+		binary.LittleEndian.PutUint32(data[41:45], binary.BigEndian.Uint32(c.Sum))
+	}
+	return data
+}
+
+// writeLegacyStore writes a FlatFile of format version older than
+// FormatVersion with 3 keys to testdir.
+func writeLegacyStore(t *testing.T, testdir string, version int) {
+
+	if err := os.MkdirAll(testdir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(testdir, filepath.Base(testdir))
+
+	// Options.
+	buf := bytes.NewBuffer(nil)
+	if version == 0 {
+		legacy := &legacyOptions{
+			CRC:            true,
+			MaxCacheMemory: 1024,
+			MaxPageSize:    4096,
+			CompactHeader:  true,
+		}
+		if err := binaryex.Write(buf, legacy); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		options := NewOptions()
+		options.CRC = true
+		options.MaxCacheMemory = 1024
+		options.MaxPageSize = 4096
+		if err := options.Marshal(buf); err != nil {
+			t.Fatal(err)
+		}
+		binary.LittleEndian.PutUint16(buf.Bytes()[len(optsig):], uint16(version))
+	}
+	if err := ioutil.WriteFile(base+"."+OptionsExt, buf.Bytes(), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	// Header and stream.
+	hbuf := bytes.NewBuffer(nil)
+	if version == 0 {
+		hbuf.Write(hdrLegacy)
+	} else {
+		hbuf.Write(hdr)
+		writeRecord(hbuf, recordVersion, []byte{byte(version), 0})
+	}
+	sbuf := bytes.NewBuffer(nil)
+	for i := 0; i < 3; i++ {
+		val := fmt.Sprintf("val%d", i)
+		c := &cell{
+			CellID:    CellID(i + 1),
+			Offset:    int64(sbuf.Len()),
+			Allocated: int64(len(val)),
+			Used:      int64(len(val)),
+		}
+		c.setSum(ChecksumCRC32, []byte(val))
+		sbuf.WriteString(val)
+		key := fmt.Sprintf("key%d", i)
+		if version == 2 {
+			payload := make([]byte, 4, 4+len(key)+cellSizeV2)
+			binary.LittleEndian.PutUint32(payload, uint32(len(key)))
+			payload = append(payload, key...)
+			payload = append(payload, marshalV2Cell(c)...)
+			writeRecord(hbuf, recordCell, payload)
+			continue
+		}
+		data := marshalLegacyCell(t, c)
+		if version == 0 {
+			binaryex.WriteString(hbuf, key)
+			binaryex.WriteNumber(hbuf, len(data))
+			hbuf.Write(data)
+			continue
+		}
+		payload := bytes.NewBuffer(nil)
+		binaryex.WriteString(payload, key)
+		payload.Write(data)
+		writeRecord(hbuf, recordCell, payload.Bytes())
+	}
+	if err := ioutil.WriteFile(base+"."+HeaderExt, hbuf.Bytes(), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(base+".0000."+StreamExt, sbuf.Bytes(), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMigrate creates FlatFiles of older format versions then migrates them.
+func TestMigrate(t *testing.T) {
+	for version := 0; version < FormatVersion; version++ {
+		testMigrate(t, version)
+	}
+}
+
+func testMigrate(t *testing.T, version int) {
+
+	testdir := "test/migrate"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	writeLegacyStore(t, testdir, version)
+
+	if _, err := Open(testdir, nil); !errors.Is(err, ErrFormatVersion) {
+		t.Fatalf("migrate v%d failed, want ErrFormatVersion, got %v", version, err)
+	}
+	migrated, err := Migrate(testdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !migrated {
+		t.Fatalf("migrate v%d failed, nothing migrated", version)
+	}
+	if migrated, err = Migrate(testdir); err != nil || migrated {
+		t.Fatalf("migrate v%d failed, migrated twice: %v", version, err)
+	}
+
+	ff, err := Open(testdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	if ff.options.MaxPageSize != 4096 || !ff.options.CRC || ff.options.MaxCacheMemory != 1024 {
+		t.Fatalf("migrate v%d failed, options not migrated: %#v", version, ff.options)
+	}
+	for i := 0; i < 3; i++ {
+		blob, err := ff.Get([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(blob) != fmt.Sprintf("val%d", i) {
+			t.Fatalf("migrate v%d failed, want 'val%d', got '%s'", version, i, string(blob))
+		}
+		cell, _ := ff.header.Cell([]byte(fmt.Sprintf("key%d", i)))
+		if cell.Checksum != ChecksumCRC32 || cell.verify(blob) != nil {
+			t.Fatalf("migrate v%d failed, checksum not migrated", version)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mirror consistency
+//
+// A synchronous mirror is written under the primary's write lock after the
+// primary applied an operation. If the mirror write fails the operation
+// returns the error although the primary applied it and the mirror is
+// diverged from the primary.
+//
+// An asynchronous mirror, see MirrorAsync, is written by a background
+// worker in the order the primary applied operations. While it keeps up,
+// the mirror holds a prefix of the primary's history: every key holds the
+// value it had in the primary at some earlier point in time, lagging by at
+// most the operations queued. Once an operation is dropped from a full
+// queue or fails on the mirror, the mirror is diverged: keys written since
+// may hold values the primary never held together and reads from the
+// mirror should not be trusted until the mirror is resynced. Scrub repairs
+// remain safe as mirror copies are verified against primary checksums.
+// A write with DurabilitySynced waits until the queue is applied and the
+// mirror synced. Divergence is reported in MirrorStats and is cleared by a
+// successful ResyncMirror. Operations still queued when the primary is
+// closed are applied before Close returns.
+//
+// Divergence of either mirror is also recorded by a marker file in the
+// mirror directory that outlives the session. A primary resyncs a marked
+// mirror when it opens it and Promote refuses to promote a marked mirror.
+
+// MirrorPolicy defines what an asynchronous mirror does when its queue is
+// full.
+type MirrorPolicy uint8
+
+const (
+	// MirrorBlock blocks writers until the queue has room, applying
+	// backpressure from the mirror to the primary.
+	MirrorBlock MirrorPolicy = iota
+	// MirrorDrop drops operations that do not fit in the queue and marks
+	// the mirror as diverged.
+	MirrorDrop
+)
+
+// MirrorStats holds asynchronous mirror metrics.
+type MirrorStats struct {
+	// Queued is the number of operations waiting in the queue.
+	Queued int
+	// Enqueued is the number of operations queued since open.
+	Enqueued uint64
+	// Applied is the number of operations applied to the mirror.
+	Applied uint64
+	// Dropped is the number of operations dropped from a full queue.
+	Dropped uint64
+	// Failed is the number of operations that failed on the mirror.
+	Failed uint64
+	// Lag is the time the oldest queued operation has been waiting, zero
+	// if the queue is empty.
+	Lag time.Duration
+	// LastError is the last error returned by the mirror, if any.
+	LastError error
+	// Diverged specifies if the mirror no longer follows the primary
+	// because an operation was dropped or failed. It is cleared by a
+	// successful ResyncMirror. It is persisted, see Mirror consistency.
+	Diverged bool
+}
+
+// mirrorOp is a queued mirror event.
+type mirrorOp struct {
+	event  Event
+	queued time.Time
+}
+
+// mirrorQueue runs asynchronous mirroring.
+type mirrorQueue struct {
+	// mutex guards stats and pending.
+	mutex sync.Mutex
+	// stats holds metrics, Queued and Lag are computed.
+	stats MirrorStats
+	// pending holds queue times of queued operations, oldest first.
+	pending []time.Time
+	// drained is signalled when pending empties.
+	drained *sync.Cond
+
+	// sink receives queued events.
+	sink Replicator
+	// marker is the divergence marker filename of the mirror.
+	marker string
+
+	ops  chan mirrorOp
+	done chan struct{}
+}
+
+// MirrorStats returns metrics of the asynchronous mirror. Returns zero
+// stats if the mirror is not asynchronous.
+func (ff *FlatFile) MirrorStats() MirrorStats {
+
+	ff.mutex.RLock()
+	q := ff.mirrorQueue
+	ff.mutex.RUnlock()
+
+	if q == nil {
+		return MirrorStats{}
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	stats := q.stats
+	stats.Queued = len(q.pending)
+	if len(q.pending) > 0 {
+		stats.Lag = time.Since(q.pending[0])
+	}
+	return stats
+}
+
+// MirrorReport is the result of CheckMirror or ResyncMirror.
+type MirrorReport struct {
+	// Keys is the number of FlatFile keys compared.
+	Keys int
+	// Missing are keys of the FlatFile missing from the mirror.
+	Missing []string
+	// Differ are keys whose blobs differ between the FlatFile and mirror.
+	Differ []string
+	// Extra are keys of the mirror missing from the FlatFile.
+	Extra []string
+	// Resynced specifies if the differences were copied to the mirror.
+	Resynced bool
+}
+
+// OK returns truth if the mirror matches the FlatFile.
+func (mr *MirrorReport) OK() bool {
+	return len(mr.Missing) == 0 && len(mr.Differ) == 0 && len(mr.Extra) == 0
+}
+
+// CheckMirror compares key sets and blobs of the FlatFile and its mirror
+// after queued asynchronous writes are applied. Blobs are compared by
+// checksum if both cells have one of the same algorithm, by content
+// otherwise. A mirror blob that fails to read differs. Writes are locked
+// during the comparison.
+//
+// Returns ErrNoMirror if no mirror is configured.
+func (ff *FlatFile) CheckMirror() (*MirrorReport, error) {
+
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	return ff.checkMirror()
+}
+
+// ResyncMirror compares the FlatFile and its mirror like CheckMirror, then
+// copies keys that are missing or differ to the mirror and deletes keys
+// that the FlatFile does not have from it. Keys that match are not
+// rewritten. A diverged mirror is no longer diverged once the resync
+// succeeds. Writes are locked during the resync.
+//
+// Returns ErrNoMirror if no mirror is configured.
+func (ff *FlatFile) ResyncMirror() (*MirrorReport, error) {
+
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	return ff.resyncMirror()
+}
+
+// Promote opens the mirror in base directory mirror as a FlatFile in place
+// of a lost primary. Mirror is checked with Check first and an error
+// wrapping ErrCorrupted is returned if problems are found; they can be
+// repaired with Repair before retrying. An error wrapping
+// ErrMirrorDiverged is returned if the mirror is marked as diverged from the
+// primary. Options are applied as with Open, options.MirrorDir specifies the
+// mirror of the promoted FlatFile, if any, which is resynced from it once
+// open. Close() MUST be called after use.
+func Promote(mirror string, options *Options) (*FlatFile, error) {
+	diverged, err := FileExists(divergedName(mirror))
+	if err != nil {
+		return nil, ErrFlatFile.Errorf("promote: %w", err)
+	}
+	if diverged {
+		return nil, ErrFlatFile.Errorf("promote: %w", ErrMirrorDiverged)
+	}
+	report, err := Check(mirror)
+	if err != nil {
+		return nil, err
+	}
+	if !report.OK() {
+		return nil, ErrFlatFile.Errorf("promote: mirror has %d problems: %w",
+			len(report.Problems), ErrCorrupted)
+	}
+	if options == nil {
+		options = NewOptions()
+	}
+	opts := *options
+	opts.MirrorDir = ""
+	opts.MirrorResync = false
+	ff, err := Open(mirror, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if options.MirrorDir == "" {
+		return ff, nil
+	}
+	// Mirror options are not persisted by a mirror, apply the caller's.
+	ff.options.MirrorDir = options.MirrorDir
+	ff.options.MirrorAsync = options.MirrorAsync
+	ff.options.MirrorQueueSize = options.MirrorQueueSize
+	ff.options.MirrorPolicy = options.MirrorPolicy
+	ff.options.MirrorResync = true
+	if err = ff.openMirror(); err != nil {
+		ff.Close()
+		return nil, err
+	}
+	return ff, nil
+}
+
+// openMirror opens the mirror in MirrorDir and starts asynchronous
+// mirroring if enabled, then resyncs the mirror if MirrorResync is set or
+// the mirror is marked as diverged.
+// A MirrorDir that is the FlatFile itself, persisted by mirrors of older
+// versions, is ignored.
+func (ff *FlatFile) openMirror() error {
+	dir, err := filepath.Abs(ff.options.MirrorDir)
+	if err != nil {
+		return ErrFlatFile.Errorf("mirror error: %w", err)
+	}
+	if self, err := filepath.Abs(ff.filename); err == nil && self == dir {
+		return nil
+	}
+	mirroropt := NewOptions()
+	*mirroropt = *ff.options
+	mirroropt.utility = true
+	// Mirror must open standalone, as a replacement for the primary.
+	mirroropt.MirrorDir = ""
+	mirroropt.MirrorAsync = false
+	mirroropt.MirrorResync = false
+	mirror, err := Open(ff.options.MirrorDir, mirroropt)
+	if err != nil {
+		return ErrFlatFile.Errorf("mirror error: %w", err)
+	}
+	ff.mirror = mirror
+	if ff.options.MirrorAsync {
+		ff.startMirrorQueue()
+	}
+	diverged, err := FileExists(divergedName(ff.options.MirrorDir))
+	if err != nil {
+		return ErrFlatFile.Errorf("mirror error: %w", err)
+	}
+	if ff.options.MirrorResync || diverged {
+		if _, err = ff.ResyncMirror(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMirror is the CheckMirror implementation.
+// Must be called with the write lock held.
+func (ff *FlatFile) checkMirror() (*MirrorReport, error) {
+	if ff.mirror == nil {
+		return nil, ErrNoMirror
+	}
+	if ff.mirrorQueue != nil {
+		ff.mirrorQueue.drain()
+	}
+
+	ff.mirror.mutex.RLock()
+	defer ff.mirror.mutex.RUnlock()
+
+	report := &MirrorReport{Keys: len(ff.header.keys)}
+	for key, c := range ff.header.keys {
+		mc, ok := ff.mirror.header.keys[key]
+		if !ok {
+			report.Missing = append(report.Missing, key)
+			continue
+		}
+		same, err := ff.sameBlob(key, c, mc)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			report.Differ = append(report.Differ, key)
+		}
+	}
+	for key := range ff.mirror.header.keys {
+		if _, ok := ff.header.keys[key]; !ok {
+			report.Extra = append(report.Extra, key)
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Differ)
+	sort.Strings(report.Extra)
+	return report, nil
+}
+
+// sameBlob returns truth if blob of cell c under key equals the blob of
+// mirror cell mc. Must be called with the write lock held and mirror read
+// lock held.
+func (ff *FlatFile) sameBlob(key string, c, mc *cell) (bool, error) {
+	if c.Used != mc.Used {
+		return false, nil
+	}
+	if c.Sum != nil && mc.Sum != nil && c.Checksum == mc.Checksum {
+		return bytes.Equal(c.Sum, mc.Sum), nil
+	}
+	blob, err := ff.get([]byte(key), false)
+	if err != nil {
+		return false, err
+	}
+	mblob, err := ff.mirror.get([]byte(key), false)
+	if err != nil {
+		return false, nil
+	}
+	return bytes.Equal(blob, mblob), nil
+}
+
+// resyncMirror is the ResyncMirror implementation.
+// Must be called with the write lock held.
+func (ff *FlatFile) resyncMirror() (*MirrorReport, error) {
+	report, err := ff.checkMirror()
+	if err != nil {
+		return nil, err
+	}
+	for _, keys := range [][]string{report.Missing, report.Differ, report.Extra} {
+		for _, key := range keys {
+			var val []byte
+			if _, ok := ff.header.keys[key]; ok {
+				if val, err = ff.get([]byte(key), false); err != nil {
+					return nil, err
+				}
+			}
+			if err = ff.mirror.replace([]byte(key), val); err != nil {
+				return nil, ErrFlatFile.Errorf("mirror error: %w", err)
+			}
+		}
+	}
+	if err = ff.mirror.commit(); err != nil {
+		return nil, ErrFlatFile.Errorf("mirror error: %w", err)
+	}
+	if err = os.Remove(divergedName(ff.options.MirrorDir)); err != nil && !os.IsNotExist(err) {
+		return nil, ErrFlatFile.Errorf("mirror error: %w", err)
+	}
+	report.Resynced = true
+	if q := ff.mirrorQueue; q != nil {
+		q.mutex.Lock()
+		q.stats.Diverged = false
+		q.mutex.Unlock()
+	}
+	return report, nil
+}
+
+// divergedName returns the divergence marker filename of the mirror in
+// base directory mirror.
+func divergedName(mirror string) string {
+	return fmt.Sprintf("%s.%s", filepath.Join(mirror, filepath.Base(mirror)), DivergedExt)
+}
+
+// markDiverged creates the divergence marker file marker, if it does not
+// exist, and syncs its directory.
+func markDiverged(marker string) error {
+	file, err := os.OpenFile(marker, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return ErrFlatFile.Errorf("mirror diverged, marker error: %w", err)
+	}
+	if err = file.Close(); err != nil {
+		return ErrFlatFile.Errorf("mirror diverged, marker error: %w", err)
+	}
+	syncDir(filepath.Dir(marker))
+	return nil
+}
+
+// replace replaces blob of key with val or deletes key if val is nil,
+// without reading the old blob as it may be damaged. It is not journaled as
+// a resync can be repeated.
+func (ff *FlatFile) replace(key, val []byte) error {
+
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	if _, ok := ff.header.Cell(key); ok {
+		if err := ff.delete(key); err != nil {
+			return err
+		}
+	}
+	if val == nil {
+		return nil
+	}
+	return ff.put(key, val)
+}
+
+// startMirrorQueue starts asynchronous mirroring.
+func (ff *FlatFile) startMirrorQueue() {
+	size := ff.options.MirrorQueueSize
+	if size < 1 {
+		size = 1
+	}
+	ff.mirrorQueue = &mirrorQueue{
+		sink:   NewFlatFileReplicator(ff.mirror),
+		marker: divergedName(ff.options.MirrorDir),
+		ops:    make(chan mirrorOp, size),
+		done:   make(chan struct{}),
+	}
+	ff.mirrorQueue.drained = sync.NewCond(&ff.mirrorQueue.mutex)
+	go ff.mirrorQueue.run()
+}
+
+// stopMirrorQueue stops asynchronous mirroring, if running, after applying
+// queued operations and waits for it to finish.
+func (ff *FlatFile) stopMirrorQueue() {
+	if ff.mirrorQueue == nil {
+		return
+	}
+	close(ff.mirrorQueue.ops)
+	<-ff.mirrorQueue.done
+	ff.mirrorQueue = nil
+}
+
+// run replicates queued events to the sink until q is closed.
+func (q *mirrorQueue) run() {
+	defer close(q.done)
+	for op := range q.ops {
+		err := q.sink.Replicate(op.event)
+		q.mutex.Lock()
+		q.pending = q.pending[1:]
+		if len(q.pending) == 0 {
+			q.drained.Broadcast()
+		}
+		if err != nil {
+			q.stats.Failed++
+			q.stats.LastError = err
+			q.diverge()
+		} else {
+			q.stats.Applied++
+		}
+		q.mutex.Unlock()
+	}
+}
+
+// diverge marks the mirror as diverged. Must be called with q.mutex held.
+func (q *mirrorQueue) diverge() {
+	if q.stats.Diverged {
+		return
+	}
+	q.stats.Diverged = true
+	if err := markDiverged(q.marker); err != nil {
+		q.stats.LastError = err
+	}
+}
+
+// drain waits until queued operations are applied.
+func (q *mirrorQueue) drain() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.pending) > 0 {
+		q.drained.Wait()
+	}
+}
+
+// push queues op according to policy.
+func (q *mirrorQueue) push(policy MirrorPolicy, op mirrorOp) {
+	op.queued = time.Now()
+	q.mutex.Lock()
+	if policy == MirrorDrop && len(q.pending) >= cap(q.ops) {
+		q.stats.Dropped++
+		q.diverge()
+		q.mutex.Unlock()
+		return
+	}
+	q.pending = append(q.pending, op.queued)
+	q.stats.Enqueued++
+	q.mutex.Unlock()
+	// Blocks if full, only pushers under the write lock fill the queue.
+	q.ops <- op
+}
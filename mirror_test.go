@@ -0,0 +1,210 @@
+package flatfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMirrorAsync(t *testing.T) {
+
+	testdir := "test/mirrorasync"
+	mirrordir := "test/mirrorasyncmirror"
+	os.RemoveAll(testdir)
+	os.RemoveAll(mirrordir)
+	defer os.RemoveAll(testdir)
+	defer os.RemoveAll(mirrordir)
+
+	options := NewOptions()
+	options.MirrorDir = mirrordir
+	options.MirrorAsync = true
+	options.MirrorQueueSize = 4
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err := ff.Put([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = key
+	}
+	for i := 0; i < 100; i += 3 {
+		key := fmt.Sprintf("key%d", i)
+		if err := ff.Delete([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, key)
+	}
+	for i := 1; i < 100; i += 3 {
+		key := fmt.Sprintf("key%d", i)
+		if err := ff.Modify([]byte(key), []byte(key+"m")); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = key + "m"
+	}
+
+	// Stall the mirror, with a full queue further writes are dropped.
+	ff.mirror.mutex.Lock()
+	ff.options.MirrorPolicy = MirrorDrop
+	for i := 0; i < 10; i++ {
+		if err := ff.Put([]byte(fmt.Sprintf("drop%d", i)), []byte("drop")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := ff.MirrorStats()
+	ff.mirror.mutex.Unlock()
+	if stats.Dropped == 0 || !stats.Diverged {
+		t.Fatalf("no drops on full queue: %+v", stats)
+	}
+	if stats.Queued == 0 || stats.Lag <= 0 {
+		t.Fatalf("no lag on stalled mirror: %+v", stats)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Divergence outlives the session.
+	if _, err := Promote(mirrordir, nil); !errors.Is(err, ErrMirrorDiverged) {
+		t.Fatalf("promoted diverged mirror, got %v", err)
+	}
+
+	// Writes before the stall reached the mirror.
+	mirror, err := Open(mirrordir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, val := range want {
+		blob, err := mirror.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(blob) != val {
+			t.Fatalf("mirror key '%s' want '%s', got '%s'", key, val, blob)
+		}
+	}
+	for i := 0; i < 100; i += 3 {
+		if _, err := mirror.Get([]byte(fmt.Sprintf("key%d", i))); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("deleted key on mirror: %v", err)
+		}
+	}
+	if err := mirror.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Diverged mirror is resynced on open.
+	options.MirrorPolicy = MirrorBlock
+	if ff, err = Open(testdir, options); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := FileExists(divergedName(mirrordir)); exists {
+		t.Fatal("divergence marker not removed by resync")
+	}
+	if report, err := ff.CheckMirror(); err != nil || !report.OK() {
+		t.Fatalf("mirror not resynced: %+v (%v)", report, err)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+	promoted, err := Promote(mirrordir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := promoted.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMirrorResyncPromote(t *testing.T) {
+
+	testdir := "test/mirrorresync"
+	mirrordir := "test/mirrorresyncmirror"
+	promoteddir := "test/mirrorresyncpromoted"
+	for _, dir := range []string{testdir, mirrordir, promoteddir} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	options := NewOptions()
+	options.MirrorDir = mirrordir
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if err := ff.Put(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mirror changes while offline.
+	mirror, err := Open(mirrordir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mirror.Delete([]byte("key1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mirror.Modify([]byte("key2"), []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mirror.Put([]byte("extra"), []byte("extra")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mirror.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ff, err = Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := ff.CheckMirror()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(report.Missing, report.Differ, report.Extra) != "[key1] [key2] [extra]" {
+		t.Fatalf("unexpected mirror report: %+v", report)
+	}
+	if report, err = ff.ResyncMirror(); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Resynced {
+		t.Fatal("mirror not resynced")
+	}
+	if report, err = ff.CheckMirror(); err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("mirror differs after resync: %+v", report)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Primary lost, promote the mirror with a new mirror.
+	os.RemoveAll(testdir)
+	options = NewOptions()
+	options.MirrorDir = promoteddir
+	ff, err = Promote(mirrordir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	if ff.Len() != 50 {
+		t.Fatalf("promoted mirror has %d keys, want 50", ff.Len())
+	}
+	if report, err = ff.CheckMirror(); err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Keys != 50 {
+		t.Fatalf("new mirror not synced: %+v", report)
+	}
+}
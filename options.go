@@ -5,12 +5,24 @@
 package flatfile
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
+	"reflect"
+	"time"
 
 	"github.com/vedranvuk/binaryex"
 )
 
 // Options defines FlatFile options.
+//
+// Options that define how a FlatFile is stored are persisted when it is
+// closed and replace those passed to Open when it is opened again. Options
+// that tune a single session, such as journaling, group commit, background
+// work, mirroring mode, the checksum algorithm and the changelog, are
+// tagged `flatfile:"session"`; they are not persisted and the values passed
+// to Open apply.
 type Options struct {
 
 	// MirrorDir specifies a directory where an exact, up-to-date mirror
@@ -19,8 +31,29 @@ type Options struct {
 	// Default value: [none]
 	MirrorDir string
 
-	// CRC specifies if a cell CRC should be done calculated on Put
-	// and checked on Get.
+	// MirrorAsync specifies if the mirror is written asynchronously by a
+	// background worker from a queue of MirrorQueueSize operations instead
+	// of under the write lock. See MirrorPolicy and MirrorStats.
+	// Default value: false
+	MirrorAsync bool `flatfile:"session"`
+
+	// MirrorQueueSize specifies the number of operations an asynchronous
+	// mirror queues before MirrorPolicy applies.
+	// Default value: 1024
+	MirrorQueueSize int `flatfile:"session"`
+
+	// MirrorPolicy specifies what an asynchronous mirror does when its
+	// queue is full.
+	// Default value: MirrorBlock
+	MirrorPolicy MirrorPolicy `flatfile:"session"`
+
+	// MirrorResync specifies if the mirror is compared to the FlatFile on
+	// Open and keys that differ are copied to it. See ResyncMirror.
+	// Default value: false
+	MirrorResync bool `flatfile:"session"`
+
+	// CRC specifies if a blob checksum should be calculated on Put
+	// and checked on Get. See Checksum.
 	// Default value: true
 	CRC bool
 
@@ -45,6 +78,17 @@ type Options struct {
 	// Default value: true
 	PreallocatePages bool
 
+	// PreallocMode specifies how pages are preallocated if PreallocatePages
+	// is true. See PreallocMode for available modes.
+	// Default value: PreallocSparse
+	PreallocMode PreallocMode
+
+	// PreallocChunkSize specifies the size of chunks in which pages are
+	// preallocated as they grow if PreallocatePages is true. If <= 0, pages
+	// are preallocated to MaxPageSize when created.
+	// Default value: 0
+	PreallocChunkSize int64
+
 	// PersistentHeader specifies if header file should be immediately appended
 	// to disk or kept in memory until FlatFile is closed.
 	// Default value: true
@@ -55,9 +99,20 @@ type Options struct {
 	// Default value: false
 	Immutable bool
 
+	// ReadOnly specifies if the FlatFile should be opened read-only. Files
+	// are opened without write access, header is not compacted, the
+	// journal is not replayed and options are not saved on Close.
+	// Methods that modify the FlatFile return ErrReadOnly. The FlatFile is
+	// locked shared with other read-only sessions and can not be opened
+	// while a writer has it open. It applies to a single session only and
+	// is not persisted.
+	// Default value: false
+	ReadOnly bool `flatfile:"session"`
+
 	// SyncWrites specifies if files should be written synchronously. This
 	// circumvents OS write caching, slows down writes considerably and tortures
-	// the disk drive. This option applies to header and stream.
+	// the disk drive. This option applies to header and stream. See
+	// GroupCommit for durable writes with fewer syncs.
 	// Default value: false
 	SyncWrites bool
 
@@ -72,20 +127,168 @@ type Options struct {
 	// CompactHeader specifies if the header should be compacted each time when
 	// loaded from file on session start.
 	// Default value: true
-	CompactHeader bool
+	CompactHeader bool `flatfile:"session"`
+
+	// UseJournal specifies if Put, Modify and Delete should be recorded in
+	// a write-ahead journal before they are applied. Operations interrupted
+	// by a crash are completed or rolled back when the FlatFile is opened.
+	// Every operation is written twice, to the journal and to the stream.
+	// A journal left by a session that enabled it is replayed on Open
+	// regardless.
+	// Default value: false
+	UseJournal bool `flatfile:"session"`
+
+	// Allocator specifies the policy used to select deleted cells for reuse
+	// by Put. See AllocPolicy for available policies.
+	// Default value: AllocBestFit
+	Allocator AllocPolicy
+
+	// MinFragmentSize specifies minimum size of unused space of a reused
+	// deleted cell that gets split off into a new deleted cell available for
+	// reuse. Smaller unused space is left unused until the cell is deleted
+	// again. If <= 0, reused cells are never split.
+	// Default value: 4096
+	MinFragmentSize int64
+
+	// PunchHoles specifies if the space of deleted cells and unused space of
+	// reused cells should be deallocated from page files, returning it to the
+	// filesystem while keeping page offsets intact. Where not supported by
+	// the platform or the filesystem the space is zero filled instead.
+	// Default value: false
+	PunchHoles bool
+
+	// ReclaimPages specifies if page files whose cells are all deleted should
+	// be removed from disk. Deleted cells on a reclaimed page are discarded.
+	// Last page is never reclaimed.
+	// Default value: false
+	ReclaimPages bool
+
+	// CompactInterval specifies the interval at which background compaction
+	// looks for pages to compact. Background compaction moves used cells
+	// from sparsely used pages to the last page in small batches then
+	// removes the emptied pages. It requires MaxPageSize > 0.
+	// If <= 0, background compaction is disabled.
+	// Default value: 0
+	CompactInterval time.Duration `flatfile:"session"`
+
+	// CompactRatio specifies the ratio of used space to MaxPageSize below
+	// which a page is compacted by background compaction.
+	// Default value: 0.5
+	CompactRatio float64 `flatfile:"session"`
+
+	// CompactBatch specifies the maximum number of cells background
+	// compaction moves while holding the write lock.
+	// Default value: 64
+	CompactBatch int `flatfile:"session"`
+
+	// CompactRate specifies the maximum number of bytes per second that
+	// background compaction moves. If <= 0, rate is unlimited.
+	// Default value: 0
+	CompactRate int64 `flatfile:"session"`
+
+	// CheckpointRecords specifies the number of records appended to header
+	// after which the header is checkpointed. A checkpoint writes a snapshot
+	// of all cells to a checkpoint file and truncates the header so that
+	// loading time depends on the number of cells, not the number of their
+	// changes. If <= 0, header is not checkpointed.
+	// Default value: 0
+	CheckpointRecords int64 `flatfile:"session"`
+
+	// StreamRecords specifies if blobs are stored in pages as self
+	// describing stream records holding the key, length, checksum and a
+	// sequence number of each blob. If the header is lost or damaged it can
+	// be rebuilt from pages with Rebuild. Stream records add 29 bytes and
+	// key length to each blob. It can not be changed once a FlatFile is
+	// created.
+	// Default value: false
+	StreamRecords bool
+
+	// Checksum specifies the algorithm used to checksum blobs written in
+	// this session if CRC is enabled. Algorithm is stored with each
+	// checksum so it can differ between sessions of a FlatFile; existing
+	// blobs keep their checksums.
+	// Default value: ChecksumCRC32
+	Checksum ChecksumAlgorithm `flatfile:"session"`
+
+	// ScrubInterval specifies the interval at which background scrubbing
+	// reads all blobs and verifies them against their checksums. Blobs that
+	// fail verification are repaired from the mirror, if one is configured,
+	// and reported to the function set with SetScrubReport.
+	// If <= 0, background scrubbing is disabled.
+	// Default value: 0
+	ScrubInterval time.Duration `flatfile:"session"`
 
-	// UseIntents specifies if intents should be used. Any destructive
-	// op is described in a separate file before the actual operation.
-	// If the operation fails it can be rolled back using the intent file.
-	// A recovery system which slows things down quite a bit.
+	// ScrubRate specifies the maximum number of bytes per second that
+	// scrubbing reads. If <= 0, rate is unlimited.
+	// Default value: 0
+	ScrubRate int64 `flatfile:"session"`
+
+	// GroupCommit specifies if writes should be made durable in batches
+	// instead of synchronously. Put, Modify and Delete return only after a
+	// background committer has synced the pages, the header and the journal
+	// that hold them. Each sync covers all operations that are waiting when
+	// it starts. Header records are queued and written once the pages they
+	// point to are synced. Ignored if SyncWrites is enabled.
+	// Default value: false
+	GroupCommit bool `flatfile:"session"`
+
+	// GroupCommitWindow specifies how long the committer waits after the
+	// first write of a batch before syncing it.
+	// Default value: 2ms
+	GroupCommitWindow time.Duration `flatfile:"session"`
+
+	// GroupCommitSize specifies the number of waiting writes after which
+	// the committer syncs a batch without waiting for GroupCommitWindow to
+	// pass. If <= 0, batches are limited only by GroupCommitWindow.
+	// Default value: 64
+	GroupCommitSize int `flatfile:"session"`
+
+	// FollowInterval specifies the interval at which a FlatFile opened with
+	// OpenFollower polls the header for changes. If <= 0, header is only
+	// followed on Refresh. It applies to a single session only and is not
+	// persisted.
+	// Default value: 100ms
+	FollowInterval time.Duration `flatfile:"session"`
+
+	// FlushInterval specifies the interval at which header records held in
+	// memory are written to the header file in the background if
+	// PersistentHeader is false. If <= 0, interval flushing is disabled.
+	// Ignored if GroupCommit is enabled.
+	// Default value: 0
+	FlushInterval time.Duration `flatfile:"session"`
+
+	// FlushDirty specifies the number of header records held in memory at
+	// which they are written to the header file in the background if
+	// PersistentHeader is false. If <= 0, threshold flushing is disabled.
+	// Ignored if GroupCommit is enabled.
+	// Default value: 0
+	FlushDirty int `flatfile:"session"`
+
+	// Changelog specifies if writes are logged to a durable changelog that
+	// consumers read with ChangesSince. Writes of a session that does not
+	// enable it are not logged and consumers of an existing changelog get
+	// ErrChangesTrimmed past them.
 	// Default value: false
-	UseIntents bool
+	Changelog bool `flatfile:"session"`
+
+	// ChangelogSize specifies the size in bytes of changes the changelog
+	// retains. If <= 0, size is unlimited.
+	// Default value: 0
+	ChangelogSize int64 `flatfile:"session"`
+
+	// ChangelogAge specifies the age of changes the changelog retains. If
+	// <= 0, age is unlimited.
+	// Default value: 0
+	ChangelogAge time.Duration `flatfile:"session"`
 
 	// filename holds the options filename once options have been persisted.
 	filename string
 
 	// utility specifies if this FlatFile is an utility for main FlatFile.
 	utility bool
+
+	// follower specifies if this FlatFile is a follower.
+	follower bool
 }
 
 // NewOptions returns a new *Options instance.
@@ -98,34 +301,175 @@ func NewOptions() *Options {
 // init initializes options to default values.
 func (o *Options) init() {
 	o.MirrorDir = ""
+	o.MirrorAsync = false
+	o.MirrorQueueSize = 1024
+	o.MirrorPolicy = MirrorBlock
+	o.MirrorResync = false
 	o.CRC = true
 	o.MaxCacheMemory = 33554432
 	o.CachedWrites = false
 	o.MaxPageSize = 4294967295 // 4GB
 	o.PreallocatePages = true
+	o.PreallocMode = PreallocSparse
+	o.PreallocChunkSize = 0
 	o.PersistentHeader = true
 	o.Immutable = false
+	o.ReadOnly = false
 	o.SyncWrites = false
 	o.ZeroPadDeleted = true
 	o.MergeAdjacentDeletes = true
 	o.CompactHeader = true
-	o.UseIntents = false
+	o.UseJournal = false
+	o.Allocator = AllocBestFit
+	o.MinFragmentSize = 4096
+	o.PunchHoles = false
+	o.ReclaimPages = false
+	o.CompactInterval = 0
+	o.CompactRatio = 0.5
+	o.CompactBatch = 64
+	o.CompactRate = 0
+	o.CheckpointRecords = 0
+	o.StreamRecords = false
+	o.Checksum = ChecksumCRC32
+	o.ScrubInterval = 0
+	o.ScrubRate = 0
+	o.GroupCommit = false
+	o.GroupCommitWindow = 2 * time.Millisecond
+	o.GroupCommitSize = 64
+	o.FollowInterval = 100 * time.Millisecond
+	o.FlushInterval = 0
+	o.FlushDirty = 0
+	o.Changelog = false
+	o.ChangelogSize = 0
+	o.ChangelogAge = 0
 }
 
+// optsig is the .options signature.
+var optsig = []byte{0xF1, 0x47, 0x0F, 0x01}
+
 // Marshal marshals Options to writer w.
-func (o *Options) Marshal(w io.Writer) error {
-	return binaryex.Write(w, o)
+//
+// Options are written as a signature and a format version followed by
+// exported fields as pairs of field name and binaryex encoded value
+// prefixed by its length. Fields of func, chan and interface types are not
+// persisted.
+func (o *Options) Marshal(w io.Writer) (err error) {
+	if _, err = w.Write(optsig); err != nil {
+		return
+	}
+	if err = binary.Write(w, binary.LittleEndian, uint16(FormatVersion)); err != nil {
+		return
+	}
+	v := reflect.ValueOf(o).Elem()
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !persistedField(field) {
+			continue
+		}
+		buf.Reset()
+		if err = binaryex.WriteReflect(buf, v.Field(i)); err != nil {
+			return ErrFlatFile.Errorf("option '%s' marshal error: %w", field.Name, err)
+		}
+		if err = binaryex.WriteString(w, field.Name); err != nil {
+			return
+		}
+		if err = binaryex.WriteNumber(w, buf.Len()); err != nil {
+			return
+		}
+		if _, err = w.Write(buf.Bytes()); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Unmarshal unmarshals Options from reader r. Fields missing from r are
+// set to defaults, unknown fields in r are ignored. Returns an error that
+// wraps ErrFormatVersion if options are not of FormatVersion.
+func (o *Options) Unmarshal(r io.Reader) (err error) {
+	version, err := o.read(r)
+	if err != nil {
+		return
+	}
+	return checkVersion(version)
 }
 
-// Unmarshal unmarshals Options from reader r.
-func (o *Options) Unmarshal(r io.Reader) error {
+// read reads Options of any format version that stores options by name from
+// reader r and returns the format version read. If options are of format
+// version 0 or newer than FormatVersion o is not modified.
+func (o *Options) read(r io.Reader) (version int, err error) {
 	no := NewOptions()
 	no.init()
-	if err := binaryex.Read(r, no); err != nil {
-		return err
+	fr := newFullReader(r)
+	sig := make([]byte, len(optsig))
+	if _, err = io.ReadFull(fr, sig); err != nil {
+		return 0, ErrFlatFile.Errorf("options signature read error: %w", err)
+	}
+	if !bytes.Equal(sig, optsig) {
+		return 0, nil
+	}
+	var ver uint16
+	if err = binary.Read(fr, binary.LittleEndian, &ver); err != nil {
+		return 0, ErrFlatFile.Errorf("options version read error: %w", err)
+	}
+	if version = int(ver); version > FormatVersion {
+		return
+	}
+	v := reflect.ValueOf(no).Elem()
+	for {
+		name := ""
+		if err = binaryex.ReadString(fr, &name); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return version, ErrFlatFile.Errorf("options read error: %w", err)
+		}
+		size := 0
+		if err = binaryex.ReadNumber(fr, &size); err != nil {
+			return version, ErrFlatFile.Errorf("option '%s' read error: %w", name, err)
+		}
+		if size < 0 {
+			return version, ErrFlatFile.Errorf("option '%s' invalid size: %w", name, ErrCorrupted)
+		}
+		data := make([]byte, size)
+		if _, err = io.ReadFull(fr, data); err != nil {
+			return version, ErrFlatFile.Errorf("option '%s' read error: %w", name, err)
+		}
+		if name == "UseIntents" {
+			// Renamed in format version 3.
+			name = "UseJournal"
+		}
+		field, ok := v.Type().FieldByName(name)
+		if !ok || !persistedField(field) {
+			continue
+		}
+		if err = binaryex.ReadReflect(bytes.NewReader(data), v.FieldByIndex(field.Index)); err != nil {
+			return version, ErrFlatFile.Errorf("option '%s' unmarshal error: %w", name, err)
+		}
 	}
 	no.filename = o.filename
 	no.utility = o.utility
+	no.follower = o.follower
+	ov := reflect.ValueOf(o).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("flatfile") == "session" {
+			v.Field(i).Set(ov.Field(i))
+		}
+	}
 	*o = *no
-	return nil
+	return version, nil
+}
+
+// persistedField returns if an Options field is persisted.
+// Fields tagged `flatfile:"session"` apply to a single session only.
+func persistedField(field reflect.StructField) bool {
+	if field.PkgPath != "" || field.Tag.Get("flatfile") == "session" {
+		return false
+	}
+	switch field.Type.Kind() {
+	case reflect.Func, reflect.Chan, reflect.Interface:
+		return false
+	}
+	return true
 }
@@ -0,0 +1,90 @@
+package flatfile
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vedranvuk/binaryex"
+)
+
+func TestOptions(t *testing.T) {
+
+	options := NewOptions()
+	options.MirrorDir = "mirror"
+	options.Allocator = AllocSizeClass
+	options.MaxPageSize = 1 << 20
+	options.MinFragmentSize = 512
+	// Session options are not persisted.
+	options.CompactInterval = time.Minute
+	options.Changelog = true
+
+	buf := bytes.NewBuffer(nil)
+	if err := options.Marshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	// A field unknown to this version is ignored.
+	binaryex.WriteString(buf, "Unknown")
+	binaryex.WriteNumber(buf, 1)
+	buf.WriteByte(0x1)
+
+	data := buf.Bytes()
+	loaded := NewOptions()
+	if err := loaded.Unmarshal(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.CompactInterval != 0 || loaded.Changelog {
+		t.Fatal("options marshaling failed, session options persisted")
+	}
+	// Session options of the receiver are kept.
+	loaded = NewOptions()
+	loaded.CompactInterval = time.Minute
+	loaded.Changelog = true
+	if err := loaded.Unmarshal(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(options, loaded) {
+		t.Fatalf("options marshaling failed, want:\n%#v\ngot:\n%#v\n", options, loaded)
+	}
+}
+
+func TestOptionsSession(t *testing.T) {
+
+	testdir := "test/optionssession"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	ff, err := Open(testdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Session options apply to an existing FlatFile.
+	options := NewOptions()
+	options.GroupCommit = true
+	options.UseJournal = true
+	options.Changelog = true
+	options.Checksum = ChecksumSHA256
+	if ff, err = Open(testdir, options); err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	if !options.GroupCommit || !options.UseJournal || !options.Changelog ||
+		options.Checksum != ChecksumSHA256 {
+		t.Fatalf("session options overwritten: %#v", options)
+	}
+	if ff.committer == nil || ff.journal == nil || ff.changelog == nil {
+		t.Fatal("session options not applied")
+	}
+	if err := ff.Put([]byte("key"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	if events, err := ff.ChangesSince(0); err != nil || len(events) != 1 {
+		t.Fatalf("want 1 change, got %d (%v)", len(events), err)
+	}
+}
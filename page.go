@@ -2,9 +2,28 @@ package flatfile
 
 import (
 	"bytes"
+	"errors"
 	"os"
+	"syscall"
 )
 
+// PreallocMode defines how page files are preallocated.
+type PreallocMode uint8
+
+const (
+	// PreallocSparse extends page files without allocating disk blocks.
+	// On most filesystems this creates a sparse file.
+	PreallocSparse PreallocMode = iota
+	// PreallocReserve reserves disk blocks for page files without writing
+	// them. Where not supported, falls back to PreallocZero.
+	PreallocReserve
+	// PreallocZero allocates disk blocks for page files by writing zeroes.
+	PreallocZero
+)
+
+// zeroChunkSize is the size of a buffer used to zero fill page space.
+const zeroChunkSize = 65536
+
 // page defines and manages a stream page on disk.
 type page struct {
 
@@ -13,6 +32,12 @@ type page struct {
 
 	// file is the underlying file of page.
 	file *os.File
+
+	// size is the size of page file.
+	size int64
+
+	// dirty specifies if page was written since last Sync.
+	dirty bool
 }
 
 // Put puts blob into page, ofset and bound by c.
@@ -34,21 +59,73 @@ func (p *page) Put(c *cell, blob []byte, zeropad bool) (err error) {
 	if _, err = p.file.Write(buf.Bytes()); err != nil {
 		return ErrFlatFile.Errorf("page write error: %w", err)
 	}
+	if end := c.Offset + int64(buf.Len()); end > p.size {
+		p.size = end
+	}
+	p.dirty = true
 	return
 }
 
-// Get returns blob defined by c.
+// Get returns blob defined by c. It is safe for concurrent use.
 func (p *page) Get(c *cell) (buf []byte, err error) {
-	if _, err = p.file.Seek(c.Offset, os.SEEK_SET); err != nil {
-		return nil, ErrFlatFile.Errorf("page seek error: %w", err)
-	}
 	buf = make([]byte, c.Used)
-	if _, err := p.file.Read(buf); err != nil {
-		return nil, ErrFlatFile.Errorf("page write error: %w", err)
+	if _, err := p.file.ReadAt(buf, c.Offset); err != nil {
+		return nil, ErrFlatFile.Errorf("page read error: %w", err)
+	}
+	return
+}
+
+// Punch deallocates size bytes of page space at offset, keeping page size
+// and offsets intact. If not supported by the platform or the filesystem
+// the space is zero filled instead.
+func (p *page) Punch(offset, size int64) (err error) {
+	if size <= 0 {
+		return nil
+	}
+	if err = punchHole(p.file, offset, size); err == nil {
+		p.dirty = true
+		return nil
+	}
+	if !errors.Is(err, ErrNotSupported) {
+		return ErrFlatFile.Errorf("page punch hole error: %w", err)
+	}
+	return p.Zero(offset, size)
+}
+
+// Zero writes size zeroes to page at offset.
+func (p *page) Zero(offset, size int64) (err error) {
+	n := int64(zeroChunkSize)
+	if size < n {
+		n = size
 	}
+	zb := make([]byte, n)
+	for size > 0 {
+		if size < n {
+			zb = zb[:size]
+		}
+		if _, err = p.file.WriteAt(zb, offset); err != nil {
+			return ErrFlatFile.Errorf("page write error: %w", err)
+		}
+		offset += int64(len(zb))
+		size -= int64(len(zb))
+	}
+	p.dirty = true
 	return
 }
 
+// Sync commits page file to stable storage if page was written since last
+// Sync.
+func (p *page) Sync() error {
+	if !p.dirty {
+		return nil
+	}
+	if err := p.file.Sync(); err != nil {
+		return ErrFlatFile.Errorf("page '%s' sync error: %w", p.filename, err)
+	}
+	p.dirty = false
+	return nil
+}
+
 // Close closes the underlying page file.
 func (p *page) Close() (err error) {
 	err = p.file.Close()
@@ -56,10 +133,41 @@ func (p *page) Close() (err error) {
 	return
 }
 
+// Allocate preallocates page file to size using mode. If page file is
+// already of size or bigger it does nothing. If there is not enough disk
+// space returns an error that wraps ErrNoSpace.
+func (p *page) Allocate(size int64, mode PreallocMode) (err error) {
+	if size <= p.size {
+		return nil
+	}
+	switch mode {
+	case PreallocReserve:
+		err = reserve(p.file, p.size, size-p.size)
+		if errors.Is(err, ErrNotSupported) {
+			err = p.Zero(p.size, size-p.size)
+		}
+	case PreallocZero:
+		err = p.Zero(p.size, size-p.size)
+	default:
+		err = p.file.Truncate(size)
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return ErrFlatFile.Errorf("page '%s' preallocate to %d bytes: %w",
+			p.filename, size, ErrNoSpace)
+	}
+	if err != nil {
+		return ErrFlatFile.Errorf("page preallocate error: %w", err)
+	}
+	p.size = size
+	p.dirty = true
+	return
+}
+
 // newPage creates a new page.
-// If prealloc and preallocSize > 0, page file is preallocated to preallocSize.
+// If prealloc and preallocSize > 0, page file is preallocated to preallocSize
+// using mode.
 // If sync, file is opened for synchronous I/O.
-func newPage(filename string, preallocSize int64, prealloc, sync bool) (p *page, err error) {
+func newPage(filename string, preallocSize int64, prealloc bool, mode PreallocMode, sync bool) (p *page, err error) {
 	flags := os.O_CREATE | os.O_RDWR
 	if sync {
 		flags |= os.O_SYNC
@@ -69,15 +177,15 @@ func newPage(filename string, preallocSize int64, prealloc, sync bool) (p *page,
 		return nil, ErrFlatFile.Errorf("create page file error: %w", err)
 	}
 	p = &page{
-		filename,
-		file,
+		filename: filename,
+		file:     file,
 	}
 	if !prealloc || preallocSize <= 0 {
 		return
 	}
-	if err = file.Truncate(preallocSize); err != nil {
+	if err = p.Allocate(preallocSize, mode); err != nil {
 		return nil, ErrFlatFile.Errorf(
-			"truncate error: %s; file close error: %w, file remove error: %s",
+			"%w; file close error: %v, file remove error: %v",
 			err, file.Close(), os.Remove(filename))
 	}
 	return
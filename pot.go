@@ -3,6 +3,7 @@ package flatfile
 // pot contains all cells in a valid flatfile.
 type pot struct {
 	maxid CellID
+	tail  *cell
 	cells map[CellID]*cell
 }
 
@@ -15,16 +16,37 @@ func newPot() *pot {
 }
 
 // New makes a new cell, unique in the flatfile.
-// It initializes it at offset after last unique cell.
+// It initializes it at offset after the tail cell.
 func (p *pot) New() (c *cell) {
 	c = &cell{}
 	c.CellState = StateNormal
-	if p.maxid > 0 {
-		c.Offset = p.cells[p.maxid].BlobEndPos()
+	if p.tail != nil {
+		c.PageIndex = p.tail.PageIndex
+		c.Offset = p.tail.BlobEndPos()
 	}
 	p.maxid++
 	p.cells[p.maxid] = c
 	c.CellID = p.maxid
+	p.tail = c
+	return
+}
+
+// Split splits c at size by shrinking c.Allocated to size and returning a
+// new deleted cell which holds the rest of c's allocated space.
+func (p *pot) Split(c *cell, size int64) (frag *cell) {
+	p.maxid++
+	frag = &cell{
+		CellID:    p.maxid,
+		CellState: StateDeleted,
+		PageIndex: c.PageIndex,
+		Offset:    c.Offset + size,
+		Allocated: c.Allocated - size,
+	}
+	p.cells[frag.CellID] = frag
+	c.Allocated = size
+	if p.tail == c {
+		p.tail = frag
+	}
 	return
 }
 
@@ -34,6 +56,9 @@ func (p *pot) Mask(c *cell) {
 		p.maxid = c.CellID
 	}
 	p.cells[c.CellID] = c
+	if p.tail == nil || p.tail.CellID == c.CellID || p.after(c, p.tail) {
+		p.tail = c
+	}
 }
 
 // Destroy destroys a cell by removing it from the pot.
@@ -48,6 +73,23 @@ func (p *pot) Destroy(c *cell) {
 	if c.CellID == p.maxid {
 		p.maxid--
 	}
+	// Find new tail.
+	if p.tail == c {
+		p.tail = nil
+		for _, cell := range p.cells {
+			if p.tail == nil || p.after(cell, p.tail) {
+				p.tail = cell
+			}
+		}
+	}
+}
+
+// after returns truth if blob of a ends after blob of b in the stream.
+func (p *pot) after(a, b *cell) bool {
+	if a.PageIndex != b.PageIndex {
+		return a.PageIndex > b.PageIndex
+	}
+	return a.BlobEndPos() > b.BlobEndPos()
 }
 
 // Walk walks the cells in the pot by calling f. Should f return false, Walk stops.
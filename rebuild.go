@@ -0,0 +1,164 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rebuild rebuilds the header of a FlatFile in base directory filename from
+// stream records in its pages, replacing the existing header and checkpoint,
+// if any. FlatFile must have been created with StreamRecords enabled and
+// must not be open, otherwise an error that wraps ErrLocked is returned. If
+// the options file is missing, default options with StreamRecords enabled
+// are written.
+//
+// For each key, a valid record not marked as deleted with the highest
+// sequence number is used. Page space not used by such records becomes
+// deleted cells available for reuse. Pages are scanned in whole.
+//
+// Returns the number of keys recovered or an error if one occurs.
+func Rebuild(filename string) (keys int, err error) {
+	bn := filepath.Base(filename)
+	if bn == "." || bn == "/" {
+		return 0, ErrFlatFile.Errorf("invalid filename: '%s'", filename)
+	}
+	base := filepath.Join(filename, bn)
+	lock, err := lockFile(fmt.Sprintf("%s.%s", base, LockExt), true)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	// Load options.
+	options := NewOptions()
+	options.filename = fmt.Sprintf("%s.%s", base, OptionsExt)
+	data, err := readFileIfExists(options.filename)
+	if err != nil {
+		return 0, err
+	}
+	if data != nil {
+		if err = options.Unmarshal(bytes.NewReader(data)); err != nil {
+			return 0, err
+		}
+		if !options.StreamRecords {
+			return 0, ErrFlatFile.Errorf("rebuild requires StreamRecords")
+		}
+	} else {
+		options.StreamRecords = true
+		buf := bytes.NewBuffer(nil)
+		if err = options.Marshal(buf); err != nil {
+			return 0, ErrFlatFile.Errorf("options marshal error: %w", err)
+		}
+		if err = replaceFile(options.filename, buf.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	// Scan pages.
+	pages, err := findPages(base)
+	if err != nil {
+		return 0, err
+	}
+	type found struct {
+		pageidx int64
+		offset  int64
+		size    int64
+		seq     uint64
+		sum     []byte
+		key     string
+	}
+	records := make([][]*found, len(pages))
+	sizes := make([]int64, len(pages))
+	winners := make(map[string]*found)
+	for i, pageidx := range pages {
+		fn := fmt.Sprintf("%s.%.4d.%s", base, pageidx, StreamExt)
+		sizes[i], err = scanBlobRecords(fn, func(rec *blobRecord) {
+			if rec.deleted {
+				return
+			}
+			f := &found{
+				pageidx: pageidx,
+				offset:  rec.offset,
+				size:    rec.size,
+				seq:     rec.seq,
+				key:     string(rec.key),
+			}
+			if options.CRC {
+				f.sum, _ = options.Checksum.Sum(rec.blob)
+			}
+			records[i] = append(records[i], f)
+			if w, ok := winners[f.key]; !ok || w.seq < f.seq {
+				winners[f.key] = f
+			}
+		})
+		if err != nil {
+			return 0, ErrFlatFile.Errorf("page '%s' scan error: %w", fn, err)
+		}
+	}
+	// Make cells.
+	h := newHeader(fmt.Sprintf("%s.%s", base, HeaderExt))
+	h.cells = newPot()
+	gap := func(pageidx, offset, end int64) {
+		if end <= offset {
+			return
+		}
+		c := h.cells.New()
+		c.CellState = StateDeleted
+		c.PageIndex = pageidx
+		c.Offset = offset
+		c.Allocated = end - offset
+	}
+	for i, pageidx := range pages {
+		end := int64(0)
+		for _, f := range records[i] {
+			if winners[f.key] != f {
+				continue
+			}
+			gap(pageidx, end, f.offset)
+			c := h.cells.New()
+			c.key = f.key
+			c.PageIndex = pageidx
+			c.Offset = f.offset
+			c.Allocated = f.size
+			c.Used = f.size
+			if f.sum != nil {
+				c.Checksum = options.Checksum
+				c.Sum = f.sum
+			}
+			end = f.offset + f.size
+		}
+		// Space after the last record on the last page is free.
+		if i < len(pages)-1 {
+			gap(pageidx, end, sizes[i])
+		}
+	}
+	if err = h.rewrite(); err != nil {
+		return 0, err
+	}
+	return len(winners), nil
+}
+
+// findPages returns sorted indexes of existing page files of a FlatFile
+// whose base filename is base.
+func findPages(base string) (pages []int64, err error) {
+	matches, err := filepath.Glob(fmt.Sprintf("%s.*.%s", base, StreamExt))
+	if err != nil {
+		return nil, ErrFlatFile.Errorf("page search error: %w", err)
+	}
+	for _, match := range matches {
+		s := strings.TrimSuffix(strings.TrimPrefix(match, base+"."), "."+StreamExt)
+		idx, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || idx < 0 {
+			continue
+		}
+		pages = append(pages, idx)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+	return
+}
@@ -0,0 +1,98 @@
+package flatfile
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRebuild(t *testing.T) {
+
+	testdir := "test/rebuild"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.MaxPageSize = 4096
+	options.StreamRecords = true
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string][]byte)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%d", i)
+		val := bytes.Repeat([]byte{byte(i)}, 100+i*10)
+		if err := ff.Put([]byte(key), val); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+	}
+	for i := 0; i < 50; i += 5 {
+		key := fmt.Sprintf("key%d", i)
+		val := bytes.Repeat([]byte{byte(i + 1)}, 50+i*20)
+		if err := ff.Modify([]byte(key), val); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+	}
+	for i := 1; i < 50; i += 7 {
+		key := fmt.Sprintf("key%d", i)
+		if err := ff.Delete([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, key)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	base := filepath.Join(testdir, filepath.Base(testdir))
+	os.Remove(base + "." + HeaderExt)
+	os.Remove(base + "." + CheckpointExt)
+
+	keys, err := Rebuild(testdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != len(want) {
+		t.Fatalf("rebuild failed, want %d keys, got %d", len(want), keys)
+	}
+
+	check := func(ff *FlatFile) {
+		if ff.Len() != len(want) {
+			t.Fatalf("rebuild failed, want %d keys, got %d", len(want), ff.Len())
+		}
+		for key, val := range want {
+			blob, err := ff.Get([]byte(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(blob, val) {
+				t.Fatalf("rebuild failed, key '%s' value mismatch", key)
+			}
+		}
+	}
+	ff, err = Open(testdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(ff)
+	for i := 50; i < 60; i++ {
+		key := fmt.Sprintf("key%d", i)
+		val := bytes.Repeat([]byte{byte(i)}, 200)
+		if err := ff.Put([]byte(key), val); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+	}
+	if err := ff.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	check(ff)
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
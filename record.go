@@ -0,0 +1,190 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// Header and checkpoint files consist of a signature followed by framed
+// records. A record is laid out as:
+//
+//	size    uint32, little endian, length of type and payload.
+//	type    uint8, record type.
+//	payload size-1 bytes.
+//	crc     uint32, little endian, crc32 (IEEE) of type and payload.
+//
+// A record that extends past the end of file is a torn write and is
+// truncated when loading. A record that fails the crc check is a torn write
+// if it is the last record in the file, otherwise the file is corrupted.
+
+// recordType defines a header record type.
+type recordType uint8
+
+const (
+	// recordCell is a cell record. Payload is the little endian uint32
+	// length of the cell key followed by the key and the marshaled cell.
+	recordCell recordType = iota + 1
+	// recordVersion is the format version record. If present, it is the
+	// first record in a file. Payload is the version as a little endian
+	// uint16.
+	recordVersion
+	// recordOp is a journal operation record, see journalEntry.
+	recordOp
+	// recordAbort is a journal abort record. Payload is the sequence
+	// number of the aborted operation as a little endian uint64.
+	recordAbort
+	// recordSync is a replication sync request or acknowledgement sent over
+	// a connection. Payload is the sequence number of the last event as a
+	// little endian uint64.
+	recordSync
+	// recordChange is a changelog change record, see change.
+	recordChange
+)
+
+const (
+	// recordFrameSize is the size of record framing without the payload.
+	recordFrameSize = 4 + 1 + 4
+	// maxRecordSize is the maximum size of a record type and payload.
+	maxRecordSize = 1 << 30
+)
+
+// errTornRecord is returned by recordReader when the last record in a file
+// is incomplete.
+var errTornRecord = errors.New("torn record")
+
+// writeRecord writes a record of type typ with payload to w using a single
+// Write call.
+func writeRecord(w io.Writer, typ recordType, payload []byte) error {
+	buf := make([]byte, recordFrameSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(1+len(payload)))
+	buf[4] = byte(typ)
+	copy(buf[5:], payload)
+	crc := crc32.ChecksumIEEE(buf[4 : 5+len(payload)])
+	binary.LittleEndian.PutUint32(buf[5+len(payload):], crc)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readRecord reads a record from a stream r, such as a connection. It
+// returns an error that wraps ErrCorrupted if the record is invalid.
+func readRecord(r io.Reader) (typ recordType, payload []byte, err error) {
+	var lbuf [4]byte
+	if _, err = io.ReadFull(r, lbuf[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int64(binary.LittleEndian.Uint32(lbuf[:]))
+	if size == 0 || size > maxRecordSize {
+		return 0, nil, ErrFlatFile.Errorf("record: invalid size %d: %w", size, ErrCorrupted)
+	}
+	buf := make([]byte, size+4)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	if binary.LittleEndian.Uint32(buf[size:]) != crc32.ChecksumIEEE(buf[:size]) {
+		return 0, nil, ErrFlatFile.Errorf("record: checksum failed: %w", ErrCorrupted)
+	}
+	return recordType(buf[0]), buf[1:size], nil
+}
+
+// recordReader reads records from a file.
+type recordReader struct {
+	r *bufio.Reader
+	// off is the offset of next record in the file.
+	off int64
+	// size is the size of the file.
+	size int64
+}
+
+// newRecordReader returns a new recordReader that reads records from r
+// positioned at offset off of a file of specified size.
+func newRecordReader(r io.Reader, off, size int64) *recordReader {
+	return &recordReader{
+		r:    bufio.NewReader(r),
+		off:  off,
+		size: size,
+	}
+}
+
+// Next reads the next record. It returns io.EOF if there are no more
+// records, errTornRecord if the last record is incomplete or the rest of the
+// file is zeros, or an error that wraps ErrCorrupted if the record is
+// invalid. Offset of the record is available through Offset until the next
+// call to Next.
+func (rr *recordReader) Next() (typ recordType, payload []byte, err error) {
+	if rr.off == rr.size {
+		return 0, nil, io.EOF
+	}
+	if rr.size-rr.off < recordFrameSize {
+		return 0, nil, errTornRecord
+	}
+	var lbuf [4]byte
+	if _, err = io.ReadFull(rr.r, lbuf[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int64(binary.LittleEndian.Uint32(lbuf[:]))
+	if size == 0 {
+		// Filesystems may extend a file with zeros on a crash during append.
+		zero, err := zeroed(rr.r, rr.size-rr.off-4)
+		if err != nil {
+			return 0, nil, err
+		}
+		if zero {
+			return 0, nil, errTornRecord
+		}
+	}
+	if size == 0 || size > maxRecordSize {
+		return 0, nil, ErrFlatFile.Errorf(
+			"record at offset %d: invalid size %d: %w", rr.off, size, ErrCorrupted)
+	}
+	end := rr.off + 4 + size + 4
+	if end > rr.size {
+		return 0, nil, errTornRecord
+	}
+	buf := make([]byte, size+4)
+	if _, err = io.ReadFull(rr.r, buf); err != nil {
+		return 0, nil, err
+	}
+	crc := binary.LittleEndian.Uint32(buf[size:])
+	if crc != crc32.ChecksumIEEE(buf[:size]) {
+		if end == rr.size {
+			return 0, nil, errTornRecord
+		}
+		return 0, nil, ErrFlatFile.Errorf(
+			"record at offset %d: checksum failed: %w", rr.off, ErrCorrupted)
+	}
+	rr.off = end
+	return recordType(buf[0]), buf[1:size], nil
+}
+
+// zeroed reads n bytes from r and reports if they are all zero.
+func zeroed(r io.Reader, n int64) (bool, error) {
+	buf := make([]byte, 4096)
+	for n > 0 {
+		l := int64(len(buf))
+		if n < l {
+			l = n
+		}
+		if _, err := io.ReadFull(r, buf[:l]); err != nil {
+			return false, err
+		}
+		for _, b := range buf[:l] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		n -= l
+	}
+	return true, nil
+}
+
+// Offset returns the offset of the next record to be read.
+func (rr *recordReader) Offset() int64 {
+	return rr.off
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+// Op defines a replicated write operation.
+type Op uint8
+
+const (
+	// OpPut is a Put operation.
+	OpPut = Op(journalPut)
+	// OpModify is a Modify operation.
+	OpModify = Op(journalModify)
+	// OpDelete is a Delete operation.
+	OpDelete = Op(journalDelete)
+)
+
+// String implements fmt.Stringer.
+func (op Op) String() string {
+	switch op {
+	case OpPut:
+		return "put"
+	case OpModify:
+		return "modify"
+	case OpDelete:
+		return "delete"
+	}
+	return "invalid"
+}
+
+// Event is a write of a FlatFile delivered to a Replicator.
+type Event struct {
+	// Seq is the sequence number of the write. It starts at 1 for the
+	// first write after Open, or continues from the last change if
+	// Changelog is enabled, and increases by one with every write.
+	Seq uint64
+	// Op is the write operation.
+	Op Op
+	// Key is the written key.
+	Key []byte
+	// Val is the new value of Put and Modify, nil for Delete.
+	Val []byte
+}
+
+// Replicator receives writes of a FlatFile in the order they were applied.
+type Replicator interface {
+	// Replicate receives event e after the FlatFile applied it, with the
+	// FlatFile write lock held. Replicator may retain e but must not modify
+	// it as it is shared with other replicators and watchers. An error is
+	// returned by the write that produced e, which is applied regardless.
+	Replicate(e Event) error
+	// Sync makes events received so far durable at the replicator. It is
+	// called on FlatFile.Sync and group commit.
+	Sync() error
+}
+
+// AddReplicator adds r to replicators that receive writes of the FlatFile,
+// starting with the next write. Replicators receive writes synchronously,
+// in the order they were added, after the mirror, if one is configured.
+// Replicators are not closed with the FlatFile.
+func (ff *FlatFile) AddReplicator(r Replicator) {
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+	ff.replicators = append(ff.replicators, r)
+}
+
+// flatFileReplicator is a Replicator that applies events to a FlatFile.
+type flatFileReplicator struct {
+	target *FlatFile
+}
+
+// NewFlatFileReplicator returns a Replicator that applies events to target
+// using Put, Modify and Delete, as the mirror does. Target may use options
+// different from the replicated FlatFile.
+func NewFlatFileReplicator(target *FlatFile) Replicator {
+	return &flatFileReplicator{target}
+}
+
+// Replicate implements Replicator.Replicate.
+func (fr *flatFileReplicator) Replicate(e Event) error {
+	switch e.Op {
+	case OpPut:
+		return fr.target.Put(e.Key, e.Val)
+	case OpModify:
+		return fr.target.Modify(e.Key, e.Val)
+	case OpDelete:
+		return fr.target.Delete(e.Key)
+	}
+	return ErrFlatFile.Errorf("invalid replication op %d", e.Op)
+}
+
+// Sync implements Replicator.Sync.
+func (fr *flatFileReplicator) Sync() error {
+	return fr.target.commit()
+}
+
+// replicate delivers operation op on key with value val, assigned event
+// sequence number seq, to the mirror, watchers and replicators. Mirror
+// receives it synchronously or through its queue. If seq is 0 the change
+// was not logged and is delivered to the mirror only. Must be called with
+// the write lock held, after the operation was applied. Returns the first
+// error, all replicators receive the event regardless.
+func (ff *FlatFile) replicate(seq uint64, op journalOp, key, val []byte) (err error) {
+	if ff.mirror == nil && len(ff.replicators) == 0 && len(ff.watchers) == 0 {
+		return nil
+	}
+	e := Event{
+		Seq: seq,
+		Op:  Op(op),
+		Key: append([]byte(nil), key...),
+	}
+	if op != journalDelete {
+		e.Val = append([]byte(nil), val...)
+	}
+	if ff.mirror != nil {
+		if ff.mirrorQueue != nil {
+			ff.mirrorQueue.push(ff.options.MirrorPolicy, mirrorOp{event: e})
+		} else if errm := NewFlatFileReplicator(ff.mirror).Replicate(e); errm != nil {
+			if errd := markDiverged(divergedName(ff.options.MirrorDir)); errd != nil {
+				errm = ErrFlatFile.Errorf("%v, %w", errm, errd)
+			}
+			if err == nil {
+				err = ErrFlatFile.Errorf("mirror error: %w", errm)
+			}
+		}
+	}
+	if seq == 0 {
+		return
+	}
+	ff.watch(e)
+	for _, r := range ff.replicators {
+		if errr := r.Replicate(e); errr != nil && err == nil {
+			err = ErrFlatFile.Errorf("replicator error: %w", errr)
+		}
+	}
+	return
+}
+
+// syncReplicators syncs replicators. Must be called with the write lock
+// held.
+func (ff *FlatFile) syncReplicators() error {
+	for _, r := range ff.replicators {
+		if err := r.Sync(); err != nil {
+			return ErrFlatFile.Errorf("replicator error: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package flatfile
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// eventLog is a Replicator that records events.
+type eventLog struct {
+	events []Event
+	syncs  int
+}
+
+func (el *eventLog) Replicate(e Event) error {
+	el.events = append(el.events, e)
+	return nil
+}
+
+func (el *eventLog) Sync() error {
+	el.syncs++
+	return nil
+}
+
+func TestReplicator(t *testing.T) {
+
+	testdir := "test/replicator"
+	localdir := "test/replicatorlocal"
+	replicadir := "test/replicatorreplica"
+	for _, dir := range []string{testdir, localdir, replicadir} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	// Replica served over TCP on localhost.
+	replica, err := Open(replicadir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ServeReplica(l, replica)
+	defer l.Close()
+	tr, err := DialReplicator(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	// Second local FlatFile with different options.
+	localopt := NewOptions()
+	localopt.CRC = false
+	localopt.PersistentHeader = false
+	local, err := Open(localdir, localopt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	ff, err := Open(testdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	log := &eventLog{}
+	ff.AddReplicator(log)
+	ff.AddReplicator(NewFlatFileReplicator(local))
+	ff.AddReplicator(tr)
+
+	for i := 0; i < 30; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if err := ff.Put(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 30; i += 3 {
+		if err := ff.Delete([]byte(fmt.Sprintf("key%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < 30; i += 3 {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if err := ff.Modify(key, append(key, 'm')); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ff.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(log.events) != 50 || log.syncs != 1 {
+		t.Fatalf("want 50 events and 1 sync, got %d and %d", len(log.events), log.syncs)
+	}
+	for i, e := range log.events {
+		if e.Seq != uint64(i+1) {
+			t.Fatalf("event %d out of order, seq %d", i, e.Seq)
+		}
+	}
+	if log.events[30].Op != OpDelete || log.events[40].Op != OpModify {
+		t.Fatalf("unexpected event ops %s, %s", log.events[30].Op, log.events[40].Op)
+	}
+	for _, target := range []*FlatFile{local, replica} {
+		if target.Len() != ff.Len() {
+			t.Fatalf("replica has %d keys, want %d", target.Len(), ff.Len())
+		}
+		err := ff.Walk(func(key, val []byte) bool {
+			blob, err := target.Get(key)
+			if err != nil || string(blob) != string(val) {
+				t.Fatalf("replica key '%s' want '%s', got '%s' (%v)", key, val, blob, err)
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplicatorTimeout(t *testing.T) {
+
+	testdir := "test/replicatortimeout"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	// Replica that accepts the connection and never acknowledges.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ioutil.ReadAll(conn)
+	}()
+	tr, err := DialReplicator(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	tr.Timeout = 50 * time.Millisecond
+
+	ff, err := Open(testdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	ff.AddReplicator(tr)
+
+	if err := ff.Put([]byte("key"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = ff.Sync()
+	var neterr net.Error
+	if !errors.As(err, &neterr) || !neterr.Timeout() {
+		t.Fatalf("want timeout error, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("sync took %v", d)
+	}
+	if err := tr.Replicate(Event{Seq: 2, Op: OpPut, Key: []byte("a")}); err == nil {
+		t.Fatal("broken replicator accepted an event")
+	}
+}
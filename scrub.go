@@ -0,0 +1,204 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"context"
+	"time"
+)
+
+// ScrubResult describes a blob that failed verification during a scrub.
+type ScrubResult struct {
+	// Key is the key of the blob.
+	Key []byte
+	// Page is the index of the page holding the blob.
+	Page int64
+	// Err is the verification error, ErrChecksumFailed if blob checksum
+	// does not match.
+	Err error
+	// Repaired specifies if the blob was repaired from the mirror.
+	Repaired bool
+	// RepairErr holds an error that prevented repair from the mirror, if a
+	// mirror is configured.
+	RepairErr error
+}
+
+// scrubber runs background scrubbing.
+type scrubber struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// SetScrubReport sets f as the function that receives blobs that failed
+// verification during background scrubbing. f is called without FlatFile
+// locks held.
+func (ff *FlatFile) SetScrubReport(f func(ScrubResult)) {
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+	ff.onScrub = f
+}
+
+// Scrub reads every blob from pages, bypassing the cache, and verifies it
+// against its checksum. Blobs that fail verification are repaired from the
+// mirror, if one is configured and holds a valid copy, and are reported
+// to fn, if not nil. Reading is throttled to ScrubRate. Blobs stored
+// without a checksum are only verified if StreamRecords is enabled.
+//
+// Scrub returns when all blobs have been verified or ctx is done, in which
+// case it returns ctx.Err().
+func (ff *FlatFile) Scrub(ctx context.Context, fn func(ScrubResult)) error {
+	for _, key := range ff.Keys() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		result, size := ff.scrubKey(key)
+		if result != nil && fn != nil {
+			fn(*result)
+		}
+		// Throttle.
+		if ff.options.ScrubRate > 0 && size > 0 {
+			d := time.Duration(size * int64(time.Second) / ff.options.ScrubRate)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(d):
+			}
+		}
+	}
+	return nil
+}
+
+// scrubKey verifies blob under key and repairs it if it failed. Returns a
+// result if verification failed and the number of bytes read.
+func (ff *FlatFile) scrubKey(key []byte) (result *ScrubResult, size int64) {
+	ff.mutex.RLock()
+	cell, ok := ff.header.Cell(key)
+	if !ok {
+		ff.mutex.RUnlock()
+		return nil, 0
+	}
+	size = cell.Used
+	id, pageidx := cell.CellID, cell.PageIndex
+	err := ff.verify(key, cell)
+	ff.mutex.RUnlock()
+	if err == nil {
+		return nil, size
+	}
+	result = &ScrubResult{Key: key, Page: pageidx, Err: err}
+	if ff.mirror != nil {
+		result.RepairErr = ff.repairFromMirror(key, id)
+		result.Repaired = result.RepairErr == nil
+	}
+	return result, size
+}
+
+// verify reads blob of cell c under key from its page and verifies it.
+func (ff *FlatFile) verify(key []byte, c *cell) error {
+	page := ff.stream.Page(c)
+	if page == nil {
+		return ErrFlatFile.Errorf("page %d missing: %w", c.PageIndex, ErrCorrupted)
+	}
+	data, err := page.Get(c)
+	if err != nil {
+		return err
+	}
+	blob := data
+	if ff.options.StreamRecords {
+		rec, err := decodeBlobRecord(data, true)
+		if err != nil {
+			return ErrFlatFile.Errorf("%v: %w", err, ErrCorrupted)
+		}
+		if string(rec.key) != string(key) {
+			return ErrFlatFile.Errorf("stream record key mismatch: %w", ErrCorrupted)
+		}
+		blob = rec.blob
+	}
+	return c.verify(blob)
+}
+
+// repairFromMirror rewrites blob of cell with specified id under key in
+// place with a copy from the mirror if the copy passes the cell checksum.
+// Nothing is done if key was deleted or moved to another cell since the
+// cell was read. The copy is verified against the cell under the write
+// lock so only a copy of the current value of key is written.
+func (ff *FlatFile) repairFromMirror(key []byte, id CellID) error {
+	blob, err := ff.mirror.Get(key)
+	if err != nil {
+		return ErrFlatFile.Errorf("mirror error: %w", err)
+	}
+
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	c, ok := ff.header.Cell(key)
+	if !ok || c.CellID != id || c.key != string(key) {
+		// Modified or deleted meanwhile.
+		return nil
+	}
+	if err = c.verify(blob); err != nil {
+		return ErrFlatFile.Errorf("mirror copy: %w", err)
+	}
+	data := ff.blobData(key, blob)
+	if int64(len(data)) != c.Used {
+		return ErrFlatFile.Errorf("mirror copy size mismatch: %w", ErrCorrupted)
+	}
+	page := ff.stream.Page(c)
+	if page == nil {
+		return ErrFlatFile.Errorf("repair error: page %d missing: %w",
+			c.PageIndex, ErrCorrupted)
+	}
+	if err = page.Put(c, data, false); err != nil {
+		return ErrFlatFile.Errorf("repair error: %w", err)
+	}
+	return nil
+}
+
+// startScrubber starts background scrubbing.
+func (ff *FlatFile) startScrubber() {
+	ctx, cancel := context.WithCancel(context.Background())
+	ff.scrubber = &scrubber{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go ff.runScrubber(ctx, ff.scrubber)
+}
+
+// stopScrubber stops background scrubbing, if running, and waits for it to
+// finish.
+func (ff *FlatFile) stopScrubber() {
+	if ff.scrubber == nil {
+		return
+	}
+	ff.scrubber.cancel()
+	<-ff.scrubber.done
+	ff.scrubber = nil
+}
+
+// runScrubber scrubs the FlatFile each ScrubInterval until ctx is done.
+func (ff *FlatFile) runScrubber(ctx context.Context, s *scrubber) {
+	defer close(s.done)
+	ticker := time.NewTicker(ff.options.ScrubInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ff.Scrub(ctx, ff.scrubReport)
+		}
+	}
+}
+
+// scrubReport reports scrub result r.
+func (ff *FlatFile) scrubReport(r ScrubResult) {
+	ff.mutex.RLock()
+	f := ff.onScrub
+	ff.mutex.RUnlock()
+	if f != nil {
+		f(r)
+	}
+}
@@ -0,0 +1,149 @@
+package flatfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestScrub(t *testing.T) {
+
+	testdir := "test/scrub"
+	testmirrordir := "test/scrubmirror"
+	os.RemoveAll(testdir)
+	os.RemoveAll(testmirrordir)
+	defer os.RemoveAll(testdir)
+	defer os.RemoveAll(testmirrordir)
+
+	options := NewOptions()
+	options.MirrorDir = testmirrordir
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	for i := 0; i < 10; i++ {
+		val := bytes.Repeat([]byte{byte(i)}, 100)
+		if err := ff.Put([]byte(fmt.Sprintf("key%d", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ff.Scrub(context.Background(), func(r ScrubResult) {
+		t.Fatalf("scrub failed, unexpected result: %v", r.Err)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage a blob.
+	damage := func(key string) {
+		cell, _ := ff.header.Cell([]byte(key))
+		if _, err := ff.stream.Page(cell).file.WriteAt([]byte{0xFF}, cell.Offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	damage("key3")
+	results := []ScrubResult{}
+	if err := ff.Scrub(context.Background(), func(r ScrubResult) {
+		results = append(results, r)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || string(results[0].Key) != "key3" ||
+		!errors.Is(results[0].Err, ErrChecksumFailed) || !results[0].Repaired {
+		t.Fatalf("scrub failed, want repaired key3, got %#v", results)
+	}
+	blob, err := ff.Get([]byte("key3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(blob, bytes.Repeat([]byte{3}, 100)) {
+		t.Fatal("scrub failed, blob not repaired")
+	}
+
+	// Repair of a cell no longer under the key is skipped.
+	damage("key5")
+	cell, _ := ff.header.Cell([]byte("key5"))
+	if err := ff.repairFromMirror([]byte("key5"), cell.CellID+100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ff.Get([]byte("key5")); !errors.Is(err, ErrChecksumFailed) {
+		t.Fatalf("stale repair written, got %v", err)
+	}
+	if err := ff.repairFromMirror([]byte("key5"), cell.CellID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ff.Get([]byte("key5")); err != nil {
+		t.Fatalf("repair failed, got %v", err)
+	}
+
+	// Background scrub without a mirror.
+	ff.mirror.Close()
+	ff.mirror = nil
+	reports := make(chan ScrubResult, 1)
+	ff.SetScrubReport(func(r ScrubResult) {
+		select {
+		case reports <- r:
+		default:
+		}
+	})
+	damage("key7")
+	ff.options.ScrubInterval = 10 * time.Millisecond
+	ff.startScrubber()
+	select {
+	case r := <-reports:
+		if string(r.Key) != "key7" || r.Repaired {
+			t.Fatalf("background scrub failed, got %#v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("background scrub failed, no report")
+	}
+	ff.stopScrubber()
+}
+
+func TestScrubMissingPage(t *testing.T) {
+
+	testdir := "test/scrubmissing"
+	testmirrordir := "test/scrubmissingmirror"
+	os.RemoveAll(testdir)
+	os.RemoveAll(testmirrordir)
+	defer os.RemoveAll(testdir)
+	defer os.RemoveAll(testmirrordir)
+
+	options := NewOptions()
+	options.MirrorDir = testmirrordir
+	options.MaxPageSize = 1024
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	for i := 0; i < 20; i++ {
+		val := bytes.Repeat([]byte{byte(i)}, 100)
+		if err := ff.Put([]byte(fmt.Sprintf("key%.2d", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Lose the first page.
+	ff.stream.pages[0].Close()
+	ff.stream.pages[0] = nil
+	results := []ScrubResult{}
+	if err := ff.Scrub(context.Background(), func(r ScrubResult) {
+		results = append(results, r)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 10 {
+		t.Fatalf("scrub failed, want 10 results, got %d", len(results))
+	}
+	for _, r := range results {
+		if r.Page != 0 || !errors.Is(r.Err, ErrCorrupted) ||
+			r.Repaired || !errors.Is(r.RepairErr, ErrCorrupted) {
+			t.Fatalf("scrub failed, unexpected result %#v", r)
+		}
+	}
+}
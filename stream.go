@@ -5,8 +5,10 @@
 package flatfile
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
 // stream manages a slice of pages.
@@ -17,6 +19,19 @@ type stream struct {
 
 	// pages holds a slice of stream page infos.
 	pages []*page
+
+	// mode is the page preallocation mode.
+	mode PreallocMode
+
+	// chunk is the size of chunks in which pages are preallocated as they
+	// grow. If <= 0, pages are preallocated to their size limit.
+	chunk int64
+
+	// created specifies if a page file was created since last Sync.
+	created bool
+
+	// readonly specifies if page files are opened read-only.
+	readonly bool
 }
 
 // newStream creates a new stream with specified filename.
@@ -34,15 +49,29 @@ func (s *stream) Open(maxPageID int64, sync bool) error {
 	if sync {
 		opt = opt | os.O_SYNC
 	}
+	if s.readonly {
+		opt = os.O_RDONLY
+	}
 	for i := int64(0); i < maxPageID; i++ {
 		fn := fmt.Sprintf("%s.%.4d.%s", s.filename, len(s.pages), StreamExt)
 		file, err := os.OpenFile(fn, opt, os.ModePerm)
+		if errors.Is(err, os.ErrNotExist) {
+			// Page was reclaimed.
+			s.pages = append(s.pages, nil)
+			continue
+		}
 		if err != nil {
 			return ErrFlatFile.Errorf("page file (%s) open error: %w", fn, err)
 		}
+		fi, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return ErrFlatFile.Errorf("page file (%s) stat error: %w", fn, err)
+		}
 		p := &page{
 			filename: fn,
 			file:     file,
+			size:     fi.Size(),
 		}
 		s.pages = append(s.pages, p)
 	}
@@ -50,15 +79,20 @@ func (s *stream) Open(maxPageID int64, sync bool) error {
 }
 
 // addNewPage creates a new page and preallocates the underlying file to
-// specified preallocSize if prealloc and preallocSize > 0.
+// specified preallocSize if prealloc and preallocSize > 0. If stream
+// preallocates in chunks, page is preallocated to a single chunk.
 func (s *stream) addNewPage(preallocSize int64, prealloc, sync bool) (idx int, p *page, err error) {
 
+	if s.chunk > 0 && (preallocSize <= 0 || s.chunk < preallocSize) {
+		preallocSize = s.chunk
+	}
 	fn := fmt.Sprintf("%s.%.4d.%s", s.filename, len(s.pages), StreamExt)
-	p, err = newPage(fn, preallocSize, prealloc, sync)
+	p, err = newPage(fn, preallocSize, prealloc, s.mode, sync)
 	if err != nil {
 		return -1, nil, ErrFlatFile.Errorf("error creating new page: %w", err)
 	}
 	s.pages = append(s.pages, p)
+	s.created = true
 	idx = len(s.pages) - 1
 	return
 }
@@ -97,6 +131,16 @@ func (s *stream) GetCellPage(c *cell, pageSizeLimit int64, prealloc, sync bool)
 			c.Offset = 0
 		}
 	}
+	// Grow page by chunks to fit c.
+	if prealloc && s.chunk > 0 {
+		size := (c.BlobEndPos() + s.chunk - 1) / s.chunk * s.chunk
+		if pageSizeLimit > 0 && size > pageSizeLimit {
+			size = pageSizeLimit
+		}
+		if err = page.Allocate(size, s.mode); err != nil {
+			return nil, err
+		}
+	}
 	// Update c.
 	c.PageIndex = int64(pageidx)
 	return
@@ -106,6 +150,9 @@ func (s *stream) GetCellPage(c *cell, pageSizeLimit int64, prealloc, sync bool)
 func (s *stream) Close() error {
 	var e error
 	for _, pagev := range s.pages {
+		if pagev == nil {
+			continue
+		}
 		if err := pagev.Close(); err != nil {
 			err = fmt.Errorf("page '%s' close error: %w", pagev.filename, err)
 			if e != nil {
@@ -122,13 +169,51 @@ func (s *stream) Close() error {
 	return nil
 }
 
+// Sync commits pages written since last Sync to stable storage, including
+// the directory entries of newly created pages.
+func (s *stream) Sync() error {
+	for _, p := range s.pages {
+		if p == nil {
+			continue
+		}
+		if err := p.Sync(); err != nil {
+			return err
+		}
+	}
+	if s.created {
+		syncDir(filepath.Dir(s.filename))
+		s.created = false
+	}
+	return nil
+}
+
+// Remove closes and removes page file of page at index idx. Page index
+// remains reserved and the page is nil.
+func (s *stream) Remove(idx int64) error {
+	p := s.pages[idx]
+	if p == nil {
+		return nil
+	}
+	if err := p.Close(); err != nil {
+		return ErrFlatFile.Errorf("page '%s' close error: %w", p.filename, err)
+	}
+	s.pages[idx] = nil
+	if err := os.Remove(p.filename); err != nil {
+		return ErrFlatFile.Errorf("page '%s' remove error: %w", p.filename, err)
+	}
+	return nil
+}
+
 // Clear clears the stream and removes page files from disk.
 func (s *stream) Clear() error {
 	// TODO Implement Clear()
 	return nil
 }
 
-// Page retrieves a page by index.
+// Page retrieves a page by index. Returns nil if page does not exist.
 func (s *stream) Page(c *cell) *page {
+	if c.PageIndex < 0 || int(c.PageIndex) >= len(s.pages) {
+		return nil
+	}
 	return s.pages[int(c.PageIndex)]
 }
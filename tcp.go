@@ -0,0 +1,200 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// TCP replication sends events over a connection as framed records, see
+// record.go. Each event is an op record holding a journalEntry without the
+// old value. Sync sends a sync record holding the sequence number of the
+// last event sent; the receiver applies events in order and answers with a
+// sync record holding the same sequence number once the replica is synced.
+
+// TCPReplicator is a reference Replicator that sends events to a replica
+// served by ServeReplica over a TCP connection. Events are buffered and
+// sent on Sync or when the buffer fills. Once a send fails or times out the
+// replicator is broken and returns the error from all calls; a new
+// replicator should be dialed and the replica resynced.
+type TCPReplicator struct {
+	// Timeout limits each send and the wait for the replica to acknowledge a
+	// Sync. Replicator calls are made under the FlatFile write lock so a
+	// stalled replica would otherwise block all writers. If zero, calls do not
+	// time out. It must be set before the replicator is used.
+	// Default value: 10s
+	Timeout time.Duration
+
+	mutex sync.Mutex
+	conn  net.Conn
+	w     *bufio.Writer
+	// last is the sequence number of the last event sent.
+	last uint64
+	// err is the error that broke the replicator, if any.
+	err error
+}
+
+// DialReplicator connects to a replica served by ServeReplica at TCP
+// address addr and returns a TCPReplicator that sends events to it.
+func DialReplicator(addr string) (*TCPReplicator, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, ErrFlatFile.Errorf("replicator dial error: %w", err)
+	}
+	return &TCPReplicator{
+		Timeout: 10 * time.Second,
+		conn:    conn,
+		w:       bufio.NewWriter(conn),
+	}, nil
+}
+
+// Replicate implements Replicator.Replicate.
+func (tr *TCPReplicator) Replicate(e Event) error {
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if tr.err != nil {
+		return tr.err
+	}
+	if err := tr.deadline(); err != nil {
+		return tr.fail(err)
+	}
+	je := &journalEntry{seq: e.Seq, op: journalOp(e.Op), key: e.Key, val: e.Val}
+	if err := writeRecord(tr.w, recordOp, je.marshal()); err != nil {
+		return tr.fail(err)
+	}
+	tr.last = e.Seq
+	return nil
+}
+
+// Sync implements Replicator.Sync. It sends buffered events and waits for
+// the replica to acknowledge they are synced.
+func (tr *TCPReplicator) Sync() error {
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if tr.err != nil {
+		return tr.err
+	}
+	if err := tr.deadline(); err != nil {
+		return tr.fail(err)
+	}
+	var seq [8]byte
+	binary.LittleEndian.PutUint64(seq[:], tr.last)
+	if err := writeRecord(tr.w, recordSync, seq[:]); err != nil {
+		return tr.fail(err)
+	}
+	if err := tr.w.Flush(); err != nil {
+		return tr.fail(err)
+	}
+	typ, payload, err := readRecord(tr.conn)
+	if err != nil {
+		return tr.fail(err)
+	}
+	if typ != recordSync || len(payload) != 8 ||
+		binary.LittleEndian.Uint64(payload) != tr.last {
+		return tr.fail(ErrFlatFile.Errorf("invalid replica acknowledgement: %w", ErrCorrupted))
+	}
+	return nil
+}
+
+// Close sends buffered events and closes the connection. It does not wait
+// for the replica to sync them.
+func (tr *TCPReplicator) Close() error {
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	var err error
+	if tr.err == nil {
+		err = tr.w.Flush()
+	}
+	if errc := tr.conn.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err != nil {
+		return ErrFlatFile.Errorf("replicator close error: %w", err)
+	}
+	return nil
+}
+
+// deadline sets the connection deadline Timeout from now, if set.
+func (tr *TCPReplicator) deadline() error {
+	if tr.Timeout <= 0 {
+		return nil
+	}
+	return tr.conn.SetDeadline(time.Now().Add(tr.Timeout))
+}
+
+// fail breaks the replicator with err and returns the wrapped error.
+func (tr *TCPReplicator) fail(err error) error {
+	tr.err = ErrFlatFile.Errorf("replicator error: %w", err)
+	return tr.err
+}
+
+// ServeReplica accepts connections from TCPReplicators on l and applies
+// their events to replica until accepting fails, for instance when l is
+// closed, and returns that error. Events are applied idempotently, like
+// journal replay, so resent events are harmless; they are not journaled
+// nor replicated further by the replica. A connection that sends invalid
+// data or whose events fail to apply is closed.
+func ServeReplica(l net.Listener, replica *FlatFile) error {
+	if replica.options.ReadOnly {
+		return ErrReadOnly
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go replica.serveReplica(conn)
+	}
+}
+
+// serveReplica applies events received over conn until it fails.
+func (ff *FlatFile) serveReplica(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		typ, payload, err := readRecord(r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case recordOp:
+			je := &journalEntry{}
+			if err = je.unmarshal(payload); err != nil {
+				return
+			}
+			if err = ff.receive(je); err != nil {
+				return
+			}
+		case recordSync:
+			if err = ff.Sync(); err != nil {
+				return
+			}
+			if err = writeRecord(conn, recordSync, payload); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// receive applies a received event.
+func (ff *FlatFile) receive(je *journalEntry) error {
+
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	return ff.ensure(je.key, je.val, je.op != journalDelete)
+}
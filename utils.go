@@ -5,7 +5,9 @@
 package flatfile
 
 import (
+	"bufio"
 	"errors"
+	"io"
 	"os"
 )
 
@@ -22,3 +24,54 @@ func FileExists(filename string) (exists bool, err error) {
 	}
 	return true, nil
 }
+
+// lockFile opens or creates lock file filename and locks it, exclusive if
+// exclusive, shared otherwise. Returns the locked file which is unlocked
+// when closed or an error that wraps ErrLocked if it is already locked
+// incompatibly.
+func lockFile(filename string, exclusive bool) (*os.File, error) {
+	flags := os.O_RDONLY
+	if exclusive {
+		flags = os.O_RDWR
+	}
+	file, err := os.OpenFile(filename, flags, os.ModePerm)
+	if errors.Is(err, os.ErrNotExist) {
+		file, err = os.OpenFile(filename, flags|os.O_CREATE, os.ModePerm)
+	}
+	if err != nil {
+		return nil, ErrFlatFile.Errorf("lock file open error: %w", err)
+	}
+	if err = flock(file, exclusive); err != nil {
+		file.Close()
+		return nil, ErrFlatFile.Errorf("lock file '%s' lock error: %w", filename, err)
+	}
+	return file, nil
+}
+
+// syncDir syncs directory dirname so that renames and removals in it are
+// persisted. Errors are ignored as not all platforms support it.
+func syncDir(dirname string) {
+	dir, err := os.Open(dirname)
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
+}
+
+// fullReader is a buffered reader whose Read reads len(p) bytes or fails.
+// binaryex reads strings with a single Read which a plain bufio.Reader may
+// satisfy only partially.
+type fullReader struct {
+	r *bufio.Reader
+}
+
+// newFullReader returns a new fullReader reading from r.
+func newFullReader(r io.Reader) *fullReader {
+	return &fullReader{bufio.NewReader(r)}
+}
+
+// Read implements io.Reader.Read.
+func (fr *fullReader) Read(p []byte) (int, error) {
+	return io.ReadFull(fr.r, p)
+}
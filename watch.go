@@ -0,0 +1,131 @@
+// Copyright 2019 Vedran Vuk. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package flatfile
+
+import (
+	"bytes"
+	"sync"
+)
+
+// WatchOpts defines options of a watch.
+type WatchOpts struct {
+	// Values specifies if events carry values of Put and Modify.
+	Values bool
+	// Buffer specifies the number of events buffered for the receiver.
+	// If <= 0, 256 is used.
+	Buffer int
+}
+
+// watcher is a watch subscription.
+type watcher struct {
+	prefix []byte
+	values bool
+	ch     chan Event
+	once   sync.Once
+}
+
+// close closes the watcher channel once.
+func (w *watcher) close() {
+	w.once.Do(func() { close(w.ch) })
+}
+
+// Watch returns a channel that receives events of writes to keys that
+// start with prefix, all keys if prefix is empty, without values, and a
+// function that cancels the watch. See WatchWith.
+func (ff *FlatFile) Watch(prefix []byte) (<-chan Event, func()) {
+	return ff.WatchWith(prefix, WatchOpts{})
+}
+
+// WatchWith returns a channel that receives events of writes to keys that
+// start with prefix, all keys if prefix is empty, and a function that
+// cancels the watch.
+//
+// Events are delivered in write order once writes are committed: after a
+// group commit syncs them if GroupCommit is enabled, after the write
+// returns otherwise. Writes never wait for the receiver. If the receiver
+// falls more than opts.Buffer events behind, the watch is cancelled and
+// the channel closed, after which the receiver should reread the keys it
+// tracks and watch again. Channel is also closed on cancel and Close.
+func (ff *FlatFile) WatchWith(prefix []byte, opts WatchOpts) (<-chan Event, func()) {
+	if opts.Buffer <= 0 {
+		opts.Buffer = 256
+	}
+	w := &watcher{
+		prefix: append([]byte(nil), prefix...),
+		values: opts.Values,
+		ch:     make(chan Event, opts.Buffer),
+	}
+
+	ff.mutex.Lock()
+	ff.watchers = append(ff.watchers, w)
+	ff.mutex.Unlock()
+
+	cancel := func() {
+		ff.mutex.Lock()
+		ff.unwatch(w)
+		ff.mutex.Unlock()
+	}
+	return w.ch, cancel
+}
+
+// unwatch removes w from watchers and closes it.
+// Must be called with the write lock held.
+func (ff *FlatFile) unwatch(w *watcher) {
+	for i, cur := range ff.watchers {
+		if cur == w {
+			ff.watchers = append(ff.watchers[:i], ff.watchers[i+1:]...)
+			break
+		}
+	}
+	w.close()
+}
+
+// watch delivers event e to watchers or holds it until the next group
+// commit if writes are deferred. Must be called with the write lock held.
+func (ff *FlatFile) watch(e Event) {
+	if len(ff.watchers) == 0 {
+		return
+	}
+	if ff.header.deferred {
+		ff.unwatched = append(ff.unwatched, e)
+		return
+	}
+	ff.notify([]Event{e})
+}
+
+// notify delivers events to watchers whose prefix matches, cancelling
+// watchers that fell behind. Must be called with the write lock held.
+func (ff *FlatFile) notify(events []Event) {
+	for _, w := range append([]*watcher(nil), ff.watchers...) {
+		for _, e := range events {
+			if !bytes.HasPrefix(e.Key, w.prefix) {
+				continue
+			}
+			if !w.values {
+				e.Val = nil
+			}
+			select {
+			case w.ch <- e:
+				continue
+			default:
+			}
+			ff.unwatch(w)
+			break
+		}
+	}
+}
+
+// closeWatchers closes all watchers.
+func (ff *FlatFile) closeWatchers() {
+
+	ff.mutex.Lock()
+	defer ff.mutex.Unlock()
+
+	for _, w := range ff.watchers {
+		w.close()
+	}
+	ff.watchers = nil
+	ff.unwatched = nil
+}
@@ -0,0 +1,125 @@
+package flatfile
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+
+	testdir := "test/watch"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	ff, err := Open(testdir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+
+	all, cancelAll := ff.Watch(nil)
+	users, cancelUsers := ff.WatchWith([]byte("user/"), WatchOpts{Values: true})
+	slow, _ := ff.WatchWith(nil, WatchOpts{Buffer: 1})
+
+	if err := ff.Put([]byte("user/1"), []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Put([]byte("item/1"), []byte("item")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Modify([]byte("user/1"), []byte("uno")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Delete([]byte("user/1")); err != nil {
+		t.Fatal(err)
+	}
+	cancelUsers()
+	if err := ff.Put([]byte("user/2"), []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	cancelAll()
+
+	want := []struct {
+		seq uint64
+		op  Op
+		key string
+		val string
+	}{
+		{1, OpPut, "user/1", "one"},
+		{3, OpModify, "user/1", "uno"},
+		{4, OpDelete, "user/1", ""},
+	}
+	i := 0
+	for e := range users {
+		if i >= len(want) {
+			t.Fatalf("unexpected event %+v", e)
+		}
+		w := want[i]
+		if e.Seq != w.seq || e.Op != w.op || string(e.Key) != w.key || string(e.Val) != w.val {
+			t.Fatalf("event %d: want %+v, got %+v", i, w, e)
+		}
+		i++
+	}
+	if i != len(want) {
+		t.Fatalf("want %d events, got %d", len(want), i)
+	}
+
+	n := 0
+	for e := range all {
+		if e.Val != nil {
+			t.Fatal("event carries value")
+		}
+		n++
+	}
+	if n != 5 {
+		t.Fatalf("want 5 events, got %d", n)
+	}
+
+	// Slow watcher is cancelled once behind.
+	n = 0
+	for range slow {
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("slow watcher want 1 event, got %d", n)
+	}
+}
+
+func TestWatchGroupCommit(t *testing.T) {
+
+	testdir := "test/watchgroupcommit"
+	os.RemoveAll(testdir)
+	defer os.RemoveAll(testdir)
+
+	options := NewOptions()
+	options.GroupCommit = true
+	options.GroupCommitWindow = time.Hour
+	ff, err := Open(testdir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _ := ff.Watch(nil)
+	if err := ff.PutWith([]byte("key"), []byte("val"), PutOpts{Durability: DurabilityNone}); err != nil {
+		t.Fatal(err)
+	}
+	// Not delivered until committed.
+	ff.mutex.Lock()
+	held := len(ff.unwatched)
+	ff.mutex.Unlock()
+	if err := ff.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-events; string(e.Key) != "key" || e.Op != OpPut {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if held != 1 {
+		t.Fatalf("want 1 event held until commit, got %d", held)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("watch not closed on Close")
+	}
+}